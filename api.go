@@ -1,12 +1,14 @@
 package dispatch
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"log"
 	"net/http"
-	"reflect"
 	"runtime/debug"
+	"sort"
+	"strings"
+	"sync/atomic"
 
 	"github.com/dgrijalva/jwt-go"
 )
@@ -16,17 +18,12 @@ type Claims struct {
 	jwt.StandardClaims
 }
 
-// ErrorBadRequest represents an error from a malformed request.
-var ErrorBadRequest = errors.New("Bad request")
-
-// ErrorNotFound represents a 404 error.
-var ErrorNotFound = errors.New("Path not found")
-
-// ErrorInternal represents some unexpected internal error.
-var ErrorInternal = errors.New("Internal error")
-
 // Context represents data about the endpoint call, such as path variables, the
 // calling user, and so on.
+//
+// Context implements context.Context, using the context of Request, so it can
+// be passed to functions that should stop when the client disconnects or the
+// endpoint's Timeout expires.
 type Context struct {
 	// Request is the original http request.
 	Request *http.Request
@@ -35,149 +32,247 @@ type Context struct {
 	// PathVars is the map of path variable names to values.
 	PathVars PathVars
 	Claims   *Claims
+	// RequestID identifies the request in logs and error responses. It is taken
+	// from the X-Request-Id header of the request if present, or generated.
+	RequestID string
+
+	// ctx overrides the context of Request, such as for an endpoint timeout.
+	ctx context.Context
+	// api is the API making the call, endpoint is the endpoint it matched, and
+	// decodeOptions are the options of the endpoint, for decoding the input.
+	api           *API
+	endpoint      *Endpoint
+	decodeOptions *DecodeOptions
+	// written is set when the handler has written the response itself, such
+	// as a mounted http.Handler, so that nothing more is written. It is shared
+	// by copies of the Context.
+	written *atomic.Bool
+	// noOutput is set if the handler returns no output value, so that a nil
+	// output is sent as 204 No Content.
+	noOutput bool
+	// matched is the endpoint that ServeHTTP matched for the request, which
+	// is used unless hooks change the method or path.
+	matched *routeMatch
+}
+
+// routeMatch is the result of matching a method and path to an endpoint.
+type routeMatch struct {
+	method, path string
+	endpoint     *Endpoint
+	pathVars     PathVars
 }
 
 // API is an object that holds all API methods and can dispatch them.
 type API struct {
+	// Endpoints lists the endpoints of the API, in the order they were added.
+	// It should be treated as read-only: only endpoints added with AddEndpoint,
+	// Handle or Mount are routed, and endpoints appended to it directly are
+	// never matched.
 	Endpoints []*Endpoint
+
+	// IgnoreTrailingSlash allows requests to match endpoints regardless of a
+	// trailing slash. If a path does not match any endpoint, it is retried with
+	// its trailing slash removed, or with one added if it had none.
+	IgnoreTrailingSlash bool
+
+	// HideInternalErrors prevents the details of unexpected errors from being
+	// sent to clients, which is recommended in production. When set, errors
+	// without an HTTPError in their chain are logged along with the request ID,
+	// and the client receives a generic message and the request ID instead.
+	// Errors that wrap an HTTPError with a status of 500 or more are logged the
+	// same way, and the client receives only the HTTPError's own message.
+	// Canceled calls and bodies over the size limit are sent with only the
+	// generic message of their status. Errors marked with Public are still
+	// sent verbatim.
+	HideInternalErrors bool
+
+	// PreRequestHooks are middleware hooks that run for every call, before the
+	// endpoint is matched. They can change the method and path that are
+	// matched. Like PostResponseHooks and Middleware, the list can be replaced
+	// or appended to after calls have been made, but not changed in place.
+	PreRequestHooks []MiddlewareHook
+
+	// PostResponseHooks run after every call, including calls that match no
+	// endpoint, and can inspect or transform the output and error. Replace or
+	// append to the list to change it.
+	PostResponseHooks []PostResponseHook
+
+	// Middleware wraps every call, outside of the API's hooks. The first
+	// middleware is the outermost.
+	//
+	// The middleware and hooks are built into a single Handler, which is only
+	// built again when one of the three lists is replaced or appended to.
+	// Setting an element of a list in place, such as Middleware[0] = m, has no
+	// effect once the API has been called.
+	Middleware []Middleware
+
+	// CORS is the cross-origin resource sharing policy of the API. If nil, any
+	// origin is allowed, without credentials, and with only the Content-Type
+	// and Authorization request headers.
+	CORS *CORSConfig
+
+	// MaxBodySize limits the size of request bodies, in bytes, for requests
+	// handled by ServeHTTP. Larger requests receive ErrorPayloadTooLarge. If
+	// zero, DefaultMaxBodySize is used, and if negative, request bodies are not
+	// limited. Endpoints can override it with their own MaxBodySize.
+	MaxBodySize int64
+
+	// Codecs are used to decode request bodies and encode responses. The codec
+	// for a request body is chosen by its Content-Type, and the codec for the
+	// response by the Accept header of the request. Requests without these
+	// headers use the first codec. If empty, only JSONCodec is used, and
+	// request bodies are decoded as JSON whatever their Content-Type.
+	Codecs []Codec
+
+	// DecodeOptions control how request bodies are decoded, unless an endpoint
+	// has its own DecodeOptions. If nil, the zero DecodeOptions are used.
+	DecodeOptions *DecodeOptions
+
+	// Compression, if set, compresses responses handled by ServeHTTP for
+	// clients that accept it. Endpoints can opt out with DisableCompression.
+	Compression *CompressionConfig
+
+	// ETags adds a strong ETag, computed from the encoded body with ETag, to
+	// successful responses to GET and HEAD requests that don't already have
+	// one. Requests with a matching If-None-Match header receive 304 Not
+	// Modified instead.
+	ETags bool
+
+	router router
+	// chain is the API's middleware and hooks wrapped around callEndpoint.
+	chain handlerChain
 }
 
+// DefaultMaxBodySize is the limit on request bodies used when API.MaxBodySize
+// is zero.
+const DefaultMaxBodySize = 10 << 20
+
 // MatchEndpoint matches a request to an endpoint, creating a map of path
-// variables in the process.
+// variables in the process. Literal path elements take priority over path
+// variables; see Validate for the full precedence rules.
+//
+// HEAD requests match GET endpoints, unless a HEAD endpoint is registered for
+// the same path. Endpoints for AnyMethod match if there is no endpoint for the
+// request's method.
 func (api *API) MatchEndpoint(method, path string) (*Endpoint, PathVars) {
-	for _, endpt := range api.Endpoints {
-		pathVars, match := endpt.pathMatcher.Match(method, path)
-		if match {
-			return endpt, pathVars
-		}
+	endpoint, pathVars := api.matchPath(method, path)
+	if endpoint == nil && method == http.MethodHead {
+		endpoint, pathVars = api.matchPath(http.MethodGet, path)
+	}
+	if endpoint == nil && method != AnyMethod {
+		return api.matchPath(AnyMethod, path)
 	}
-	return nil, nil
+	return endpoint, pathVars
 }
 
-// Call sends the input to the endpoint and returns the result.
-func (api *API) Call(method, path string, ctx *Context, input json.RawMessage) (out interface{}, err error) {
-	// Recover from any panics, and return an internal error in that case
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("API.Call panic: %v\n", r)
-			debug.PrintStack()
-			out = nil
-			err = errors.New("Internal error")
+// matchPath matches an endpoint for exactly the given method.
+func (api *API) matchPath(method, path string) (*Endpoint, PathVars) {
+	endpoint, pathVars := api.router.match(method, path)
+	if endpoint == nil && api.IgnoreTrailingSlash && strings.Trim(path, "/") != "" {
+		if strings.HasSuffix(path, "/") {
+			return api.router.match(method, path[:len(path)-1])
 		}
-	}()
-
-	if ctx == nil {
-		ctx = &Context{}
+		return api.router.match(method, path+"/")
 	}
+	return endpoint, pathVars
+}
 
-	endpoint, pathVars := api.MatchEndpoint(method, path)
-	if endpoint == nil {
-		return nil, ErrorNotFound
-	}
-	ctx.PathVars = pathVars
+// hasEndpoint reports whether an endpoint matches the method and path.
+func (api *API) hasEndpoint(method, path string) bool {
+	endpoint, _ := api.MatchEndpoint(method, path)
+	return endpoint != nil
+}
 
-	for _, hook := range endpoint.PreRequestHooks {
-		originalInput := &EndpointInput{method, path, ctx, input}
-		modifiedInput, err := hook(originalInput)
-		if err != nil {
-			return nil, err
+// AllowedMethods returns the methods of the endpoints that match a path, in
+// sorted order. AnyMethod is not included.
+func (api *API) AllowedMethods(path string) []string {
+	var methods []string
+	var get, head bool
+	for method := range api.router.trees {
+		if endpoint, _ := api.matchPath(method, path); endpoint == nil || method == AnyMethod {
+			continue
 		}
-		method = modifiedInput.Method
-		path = modifiedInput.Path
-		ctx = modifiedInput.Ctx
-		input = modifiedInput.Input
+		methods = append(methods, method)
+		get = get || method == http.MethodGet
+		head = head || method == http.MethodHead
 	}
+	if get && !head {
+		methods = append(methods, http.MethodHead)
+	}
+	sort.Strings(methods)
+	return methods
+}
 
-	handlerType := reflect.TypeOf(endpoint.Handler)
-	if handlerType.Kind() != reflect.Func {
-		log.Printf("Bad handler type for %s: %s\n", endpoint.Path, handlerType.Kind())
-		return nil, ErrorInternal
+// noMatchError returns the error for a request that matches no endpoint:
+// ErrorMethodNotAllowed with an Allow header if other methods are registered
+// for the path, or else ErrorNotFound.
+func (api *API) noMatchError(path string) error {
+	methods := api.AllowedMethods(path)
+	if len(methods) == 0 {
+		return ErrorNotFound
 	}
+	err := *ErrorMethodNotAllowed.(*HTTPError)
+	err.Header = http.Header{"Allow": {strings.Join(withOptions(methods), ", ")}}
+	return &err
+}
 
-	// Handler functions can take a custom value type and/or a context input
-	if handlerType.NumIn() > 2 {
-		log.Printf("Handler %s takes too many args\n", endpoint.Path)
-		return nil, ErrorInternal
+// withOptions adds OPTIONS to a sorted list of methods, since OPTIONS requests
+// are answered automatically for every path that has endpoints.
+func withOptions(methods []string) []string {
+	i := sort.SearchStrings(methods, "OPTIONS")
+	if i < len(methods) && methods[i] == "OPTIONS" {
+		return methods
 	}
-	var inputType reflect.Type
-	var takesContext, takesCustom, ctxPointer bool
-	var ctxIndex, customIndex int
-	for i := 0; i < handlerType.NumIn(); i++ {
-		inType := handlerType.In(i)
-		if inType == reflect.TypeOf(Context{}) {
-			takesContext = true
-			ctxIndex = i
-		} else if inType == reflect.TypeOf(&Context{}) {
-			takesContext = true
-			ctxPointer = true
-			ctxIndex = i
-		} else {
-			takesCustom = true
-			customIndex = i
-			inputType = handlerType.In(i)
-		}
+	return append(methods, "OPTIONS")
+}
+
+// Call sends the input to the endpoint and returns the result.
+//
+// The API's Middleware, PostResponseHooks and PreRequestHooks wrap every call,
+// in that order from the outside in, and run before the endpoint is matched.
+// They apply to every call, including those that match no endpoint. The
+// endpoint's own Middleware, PostResponseHooks, PreRequestHooks and handler
+// run next.
+func (api *API) Call(method, path string, ctx *Context, input json.RawMessage) (out interface{}, err error) {
+	// Recover from any panics, and return an internal error in that case
+	defer recoverInternal(&out, &err)
+
+	if ctx == nil {
+		ctx = &Context{}
 	}
+	ctx.api = api
 
-	handlerValue := reflect.ValueOf(endpoint.Handler)
-
-	var resultValues []reflect.Value
-	if takesCustom || takesContext {
-		// Can return any interface and/or an error
-		inputList := make([]reflect.Value, handlerType.NumIn())
-		if takesContext {
-			if ctxPointer {
-				inputList[ctxIndex] = reflect.ValueOf(ctx)
-			} else {
-				inputList[ctxIndex] = reflect.ValueOf(*ctx)
-			}
-		}
-		if takesCustom {
-			inputVal := reflect.New(inputType)
-			inputInterface := inputVal.Interface()
-			err = json.Unmarshal(input, inputInterface)
-			if err != nil {
-				return nil, err
-			}
-			directInput := reflect.Indirect(reflect.ValueOf(inputInterface))
-			inputList[customIndex] = directInput
-		}
+	handler := api.chain.get(api.callEndpoint, api.Middleware, api.PreRequestHooks, api.PostResponseHooks, 0)
+	return handler(&EndpointInput{method, path, ctx, input})
+}
 
-		resultValues = handlerValue.Call(inputList)
+// callEndpoint matches the input to an endpoint, and calls its hooks and
+// handler.
+func (api *API) callEndpoint(in *EndpointInput) (interface{}, error) {
+	var endpoint *Endpoint
+	var pathVars PathVars
+	if m := in.Ctx.matched; m != nil && m.method == in.Method && m.path == in.Path {
+		endpoint, pathVars = m.endpoint, m.pathVars
 	} else {
-		resultValues = handlerValue.Call(nil)
+		endpoint, pathVars = api.MatchEndpoint(in.Method, in.Path)
 	}
-
-	if len(resultValues) > 2 {
-		log.Printf("Handler %s returned too many values\n", endpoint.Path)
-		return nil, ErrorInternal
+	if endpoint == nil {
+		return nil, api.noMatchError(in.Path)
 	}
+	in.Ctx.PathVars = pathVars
+	in.Ctx.endpoint = endpoint
+	in.Ctx.decodeOptions = api.decodeOptions(endpoint)
 
-	if len(resultValues) == 2 {
-		// If a value and error are returned, they must be in the order (out, error)
-		out = resultValues[0].Interface()
-		if errVal := resultValues[1].Interface(); errVal == nil {
-			err = nil
-		} else {
-			err = errVal.(error)
-		}
-		return
-	}
+	return endpoint.handlerChain()(in)
+}
 
-	if len(resultValues) == 1 {
-		// Function may return _either_ an error or a value
-		retval := resultValues[0].Interface()
-		// If nil, it doesn't matter
-		if retval == nil {
-			return nil, nil
-		}
-		// Otherwise, check if it can be asserted as an error
-		returnErr, ok := retval.(error)
-		if ok {
-			return nil, returnErr
-		}
-		// Otherwise, assume it's data
-		return retval, nil
+// recoverInternal recovers from a panic when deferred, and replaces the
+// results of the panicking function with ErrorInternal.
+func recoverInternal(out *interface{}, err *error) {
+	if r := recover(); r != nil {
+		log.Printf("API.Call panic: %v\n", r)
+		debug.PrintStack()
+		*out = nil
+		*err = ErrorInternal
 	}
-
-	return nil, nil
 }
@@ -2,7 +2,6 @@ package auth
 
 import (
 	"database/sql"
-	"errors"
 	"log"
 	"net/http"
 	"time"
@@ -26,7 +25,17 @@ type LoginManager struct {
 }
 
 // ErrorIncorrectLogin represents a failed login attempt.
-var ErrorIncorrectLogin = errors.New("Invalid username or password")
+var ErrorIncorrectLogin error = dispatch.NewHTTPError(http.StatusUnauthorized, "incorrect_login", "Invalid username or password")
+
+// ErrorUserExists represents a signup attempt for a username that is taken.
+var ErrorUserExists error = dispatch.NewHTTPError(http.StatusConflict, "user_exists", "User already exists")
+
+// ErrorMissingToken represents a request without an authorization token.
+var ErrorMissingToken error = dispatch.NewHTTPError(http.StatusUnauthorized, "missing_token", "Missing authorization token")
+
+// ErrorInvalidToken represents a request with an invalid or expired
+// authorization token.
+var ErrorInvalidToken error = dispatch.NewHTTPError(http.StatusUnauthorized, "invalid_token", "Invalid authorization token")
 
 // UserLogin stores the information needed for a login attempt.
 type UserLogin struct {
@@ -45,14 +54,14 @@ type SavedUser struct {
 // is returned.
 func (lm *LoginManager) SignupUser(login UserLogin, ctx *dispatch.Context) (err error) {
 	existing := SavedUser{}
-	err = lm.DB.Table("users").GetObject(login.Username, &existing)
+	err = lm.DB.Table("users").GetObjectContext(ctx, login.Username, &existing)
 	if err != nil && err != sql.ErrNoRows {
 		return err
 	}
 
 	if existing.Username != "" {
 		log.Println("User already exists")
-		return errors.New("User already exists")
+		return ErrorUserExists
 	}
 
 	hashed, err := GetHash(login.Password)
@@ -60,7 +69,7 @@ func (lm *LoginManager) SignupUser(login UserLogin, ctx *dispatch.Context) (err
 		return err
 	}
 
-	err = lm.DB.Table("users").SetObject(login.Username, SavedUser{login.Username, hashed})
+	err = lm.DB.Table("users").SetObjectContext(ctx, login.Username, SavedUser{login.Username, hashed})
 	if err != nil {
 		return err
 	}
@@ -72,7 +81,10 @@ func (lm *LoginManager) SignupUser(login UserLogin, ctx *dispatch.Context) (err
 // credentials, returning an access token if the credentials match.
 func (lm *LoginManager) AuthenticateUser(login UserLogin, ctx *dispatch.Context) (err error) {
 	existing := SavedUser{}
-	err = lm.DB.Table("users").GetObject(login.Username, &existing)
+	err = lm.DB.Table("users").GetObjectContext(ctx, login.Username, &existing)
+	if kvstore.IsErrNoRows(err) {
+		return ErrorIncorrectLogin
+	}
 	if err != nil {
 		return err
 	}
@@ -132,15 +144,16 @@ func (lm *LoginManager) LogoutUser(ctx *dispatch.Context) {
 // token, or the token is invalid, it returns an error.
 //
 // This hook effectively acts as a requirement that the authorization token is correct.
+// Its errors are HTTPErrors with status 401.
 func AuthorizerHook(token *TokenSigner) dispatch.MiddlewareHook {
 	return func(input *dispatch.EndpointInput) (*dispatch.EndpointInput, error) {
 		// Check for authorization header
 		if input == nil {
-			return nil, errors.New("Missing authorization token")
+			return nil, ErrorMissingToken
 		}
 		authToken, err := input.Ctx.Request.Cookie("dispatch-auth")
 		if authToken == nil || authToken.Value == "" {
-			return nil, errors.New("Missing authorization token")
+			return nil, ErrorMissingToken
 		}
 		if err != nil {
 			return nil, err
@@ -148,7 +161,7 @@ func AuthorizerHook(token *TokenSigner) dispatch.MiddlewareHook {
 
 		claims, err := token.ParseToken(authToken.Value)
 		if err != nil {
-			return nil, errors.New("Invalid authorization token")
+			return nil, ErrorInvalidToken
 		}
 		input.Ctx.Claims = claims
 		return input, nil
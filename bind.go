@@ -0,0 +1,157 @@
+package dispatch
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// Struct tags used to bind request values to handler input fields.
+var bindingTags = []string{"path", "query", "header"}
+
+// A fieldBinding describes a handler input field that is filled from the path
+// variables, query string, or headers of a request.
+type fieldBinding struct {
+	index []int
+	// source is the struct tag that the binding came from, and name is its
+	// value.
+	source string
+	name   string
+}
+
+// fieldBindings returns the bindings for the fields of a struct type, or nil if
+// t is not a struct. It returns an error if a bound field has a type that
+// setField cannot convert to.
+func fieldBindings(t reflect.Type) (bindings []fieldBinding, err error) {
+	if t.Kind() != reflect.Struct {
+		return nil, nil
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// Unexported field
+			continue
+		}
+		for _, tag := range bindingTags {
+			if name, ok := field.Tag.Lookup(tag); ok && name != "" && name != "-" {
+				if !canSetField(field.Type) {
+					return nil, fmt.Errorf("field %s has unsupported type %s for %s binding", field.Name, field.Type, tag)
+				}
+				bindings = append(bindings, fieldBinding{field.Index, tag, name})
+				break
+			}
+		}
+	}
+	return bindings, nil
+}
+
+// bindFields sets each bound field of the struct value v from ctx. Fields
+// whose value is not present in the request are left unchanged. If a value
+// cannot be converted to the field's type, the returned error wraps
+// ErrorBadRequest.
+func bindFields(v reflect.Value, bindings []fieldBinding, ctx *Context) error {
+	for _, b := range bindings {
+		var values []string
+		switch b.source {
+		case "path":
+			if val, ok := ctx.PathVars[b.name]; ok {
+				values = []string{val}
+			}
+		case "query":
+			if ctx.Request != nil {
+				values = ctx.Request.URL.Query()[b.name]
+			}
+		case "header":
+			if ctx.Request != nil {
+				values = ctx.Request.Header.Values(b.name)
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		if err := setField(v.FieldByIndex(b.index), values); err != nil {
+			return fmt.Errorf("%w: %s %s: %v", ErrorBadRequest, b.source, b.name, err)
+		}
+	}
+	return nil
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// canSetField reports whether setField can convert strings to type t.
+func canSetField(t reflect.Type) bool {
+	if reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice:
+		return canSetField(t.Elem())
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// setField converts the string values to the type of field and stores them.
+// Slice fields receive every value; other fields receive the first one.
+func setField(field reflect.Value, values []string) error {
+	if reflect.PtrTo(field.Type()).Implements(textUnmarshalerType) {
+		return field.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(values[0]))
+	}
+
+	switch field.Kind() {
+	case reflect.Ptr:
+		elem := reflect.New(field.Type().Elem())
+		if err := setField(elem.Elem(), values); err != nil {
+			return err
+		}
+		field.Set(elem)
+		return nil
+	case reflect.Slice:
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, val := range values {
+			if err := setField(slice.Index(i), []string{val}); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+		return nil
+	}
+
+	val := values[0]
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", val)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(val, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", val)
+		}
+		field.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(val, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid unsigned integer %q", val)
+		}
+		field.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(val, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number %q", val)
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
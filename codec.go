@@ -0,0 +1,263 @@
+package dispatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Codec encodes and decodes request and response bodies of one media type.
+// Codecs for formats such as MessagePack or CBOR can be added to API.Codecs by
+// wrapping the Marshal and Unmarshal functions of their packages.
+type Codec interface {
+	// ContentType returns the media type of the codec, such as
+	// "application/json".
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec encodes and decodes JSON with the encoding/json package. It is
+// the default codec of an API.
+type JSONCodec struct{}
+
+// ContentType implements Codec.
+func (JSONCodec) ContentType() string { return "application/json" }
+
+// Marshal implements Codec.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+// Unmarshal implements Codec.
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// FormCodec encodes and decodes URL-encoded forms, as sent by HTML forms. It
+// decodes into structs, url.Values and map[string]string. Struct fields are
+// matched by their form tag, such as `form:"name"`, or else by the name in
+// their json tag, or their field name. Fields can have any type supported by
+// path, query and header bindings.
+type FormCodec struct{}
+
+// ContentType implements Codec.
+func (FormCodec) ContentType() string { return "application/x-www-form-urlencoded" }
+
+// Marshal implements Codec. It encodes url.Values, map[string]string, and
+// structs with fields of basic types or slices of them.
+func (FormCodec) Marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case url.Values:
+		return []byte(v.Encode()), nil
+	case map[string]string:
+		values := url.Values{}
+		for key, val := range v {
+			values.Set(key, val)
+		}
+		return []byte(values.Encode()), nil
+	}
+
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot encode %T as a form", v)
+	}
+	values := url.Values{}
+	for i := 0; i < rv.NumField(); i++ {
+		name, ok := formFieldName(rv.Type().Field(i))
+		if !ok {
+			continue
+		}
+		field := rv.Field(i)
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				continue
+			}
+			field = field.Elem()
+		}
+		if field.Kind() == reflect.Slice {
+			for j := 0; j < field.Len(); j++ {
+				values.Add(name, fmt.Sprint(field.Index(j).Interface()))
+			}
+			continue
+		}
+		values.Set(name, fmt.Sprint(field.Interface()))
+	}
+	return []byte(values.Encode()), nil
+}
+
+// Unmarshal implements Codec. Conversion errors wrap ErrorBadRequest.
+func (FormCodec) Unmarshal(data []byte, v interface{}) error {
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrorBadRequest, err)
+	}
+	switch v := v.(type) {
+	case *url.Values:
+		*v = values
+		return nil
+	case *map[string]string:
+		*v = make(map[string]string, len(values))
+		for key := range values {
+			(*v)[key] = values.Get(key)
+		}
+		return nil
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("cannot decode a form into %T", v)
+	}
+	rv = rv.Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		name, ok := formFieldName(field)
+		if !ok || len(values[name]) == 0 {
+			continue
+		}
+		if !canSetField(field.Type) {
+			return fmt.Errorf("field %s has unsupported type %s for form decoding", field.Name, field.Type)
+		}
+		if err := setField(rv.Field(i), values[name]); err != nil {
+			return fmt.Errorf("%w: form %s: %v", ErrorBadRequest, name, err)
+		}
+	}
+	return nil
+}
+
+// formFieldName returns the form key of a struct field, or false if the field
+// is unexported or ignored.
+func formFieldName(field reflect.StructField) (string, bool) {
+	// An embedded Response sets the status and headers, and isn't part of
+	// the body
+	if field.PkgPath != "" || field.Anonymous && (field.Type == responseType || field.Type == responsePtrType) {
+		return "", false
+	}
+	for _, tag := range []string{"form", "json"} {
+		if name, ok := field.Tag.Lookup(tag); ok {
+			name, _, _ = strings.Cut(name, ",")
+			if name == "-" {
+				return "", false
+			}
+			if name != "" {
+				return name, true
+			}
+		}
+	}
+	return field.Name, true
+}
+
+// defaultCodecs are used when API.Codecs is empty.
+var defaultCodecs = []Codec{JSONCodec{}}
+
+func (api *API) codecs() []Codec {
+	if len(api.Codecs) == 0 {
+		return defaultCodecs
+	}
+	return api.Codecs
+}
+
+// requestCodec returns the codec for the Content-Type of the request, or
+// ErrorUnsupportedMediaType if there is none. Requests without a Content-Type
+// use the first codec. If API.Codecs is empty, every body is decoded as JSON
+// whatever its Content-Type, since clients such as fetch and curl send JSON
+// as text/plain or application/x-www-form-urlencoded by default.
+func (c *Context) requestCodec() (Codec, error) {
+	if c.api == nil || len(c.api.Codecs) == 0 {
+		return defaultCodecs[0], nil
+	}
+	codecs := c.api.Codecs
+	if c.Request == nil || c.Request.Header.Get("Content-Type") == "" {
+		return codecs[0], nil
+	}
+	mediaType, _, err := mime.ParseMediaType(c.Request.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorUnsupportedMediaType, err)
+	}
+	for _, codec := range codecs {
+		if strings.EqualFold(codecMediaType(codec), mediaType) {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrorUnsupportedMediaType, mediaType)
+}
+
+// negotiateCodec returns the codec preferred by an Accept header, or
+// ErrorNotAcceptable if none of the codecs are acceptable. If accept is empty,
+// the first codec is used.
+func negotiateCodec(codecs []Codec, accept string) (Codec, error) {
+	mediaTypes := make([]string, len(codecs))
+	for i, codec := range codecs {
+		mediaTypes[i] = codecMediaType(codec)
+	}
+	i, err := negotiate(accept, mediaTypes)
+	if err != nil {
+		return nil, err
+	}
+	return codecs[i], nil
+}
+
+// negotiate returns the index of the media type preferred by an Accept header,
+// or ErrorNotAcceptable if none of them are acceptable. Media types that are
+// equally preferred by the header are chosen in order. If accept is empty, the
+// first media type is used.
+func negotiate(accept string, mediaTypes []string) (int, error) {
+	if accept == "" {
+		return 0, nil
+	}
+	type acceptRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, acceptRange{mediaType, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	for _, r := range ranges {
+		for i, mediaType := range mediaTypes {
+			if mediaTypeMatches(r.mediaType, mediaType) {
+				return i, nil
+			}
+		}
+	}
+	return 0, ErrorNotAcceptable
+}
+
+// codecMediaType returns the media type of a codec, without parameters.
+func codecMediaType(codec Codec) string {
+	mediaType, _, err := mime.ParseMediaType(codec.ContentType())
+	if err != nil {
+		return codec.ContentType()
+	}
+	return mediaType
+}
+
+// mediaTypeMatches reports whether a media range from an Accept header, such
+// as "application/*", matches a media type.
+func mediaTypeMatches(mediaRange, mediaType string) bool {
+	if mediaRange == "*/*" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(mediaRange, "/*"); ok {
+		return strings.EqualFold(prefix+"/", mediaType[:strings.IndexByte(mediaType, '/')+1])
+	}
+	return strings.EqualFold(mediaRange, mediaType)
+}
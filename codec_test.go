@@ -0,0 +1,108 @@
+package dispatch_test
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/olafal0/dispatch"
+)
+
+// xmlCodec is an example of a codec for another format.
+type xmlCodec struct{}
+
+func (xmlCodec) ContentType() string                        { return "application/xml" }
+func (xmlCodec) Marshal(v interface{}) ([]byte, error)      { return xml.Marshal(v) }
+func (xmlCodec) Unmarshal(data []byte, v interface{}) error { return xml.Unmarshal(data, v) }
+
+type codecUser struct {
+	Name  string   `json:"name" xml:"name"`
+	Age   int      `json:"age" xml:"age"`
+	Roles []string `json:"roles" form:"role" xml:"role"`
+}
+
+func TestCodecs(t *testing.T) {
+	api := &dispatch.API{Codecs: []dispatch.Codec{dispatch.JSONCodec{}, xmlCodec{}, dispatch.FormCodec{}}}
+	api.AddEndpoint("POST/users", func(u codecUser) codecUser { return u })
+
+	tests := []struct {
+		contentType, accept, body string
+		status                    int
+		responseType, response    string
+	}{
+		{"", "", `{"name":"a","age":1}`, http.StatusOK, "application/json", `{"name":"a","age":1,"roles":null}`},
+		{"application/json; charset=utf-8", "application/xml", `{"name":"a","age":1}`, http.StatusOK, "application/xml", `<codecUser><name>a</name><age>1</age></codecUser>`},
+		{"application/xml", "text/html, application/*;q=0.5", `<codecUser><name>b</name></codecUser>`, http.StatusOK, "application/json", `{"name":"b","age":0,"roles":null}`},
+		{"application/x-www-form-urlencoded", "application/x-www-form-urlencoded", "name=c&age=3&role=x&role=y", http.StatusOK, "application/x-www-form-urlencoded", "age=3&name=c&role=x&role=y"},
+		{"application/x-www-form-urlencoded", "", "age=old", http.StatusBadRequest, "", ""},
+		{"text/plain", "", "hello", http.StatusUnsupportedMediaType, "", ""},
+		{"", "text/html", `{"name":"a"}`, http.StatusNotAcceptable, "", ""},
+		{"", "application/xml;q=0, */*", `{"name":"a"}`, http.StatusOK, "application/json", `{"name":"a","age":0,"roles":null}`},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/users", strings.NewReader(test.body))
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s -> %s: expected status %d, got %d %q", test.contentType, test.accept, test.status, rec.Code, rec.Body.String())
+			continue
+		}
+		if test.response == "" {
+			continue
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != test.responseType {
+			t.Errorf("%s -> %s: unexpected Content-Type %q", test.contentType, test.accept, ct)
+		}
+		if rec.Body.String() != test.response {
+			t.Errorf("%s -> %s: unexpected response %q", test.contentType, test.accept, rec.Body.String())
+		}
+	}
+
+	// Without Codecs, every body is decoded as JSON
+	api = &dispatch.API{}
+	api.AddEndpoint("POST/users", func(u codecUser) codecUser { return u })
+	for _, contentType := range []string{"text/plain;charset=UTF-8", "application/x-www-form-urlencoded", "application/json"} {
+		req := httptest.NewRequest("POST", "/users", strings.NewReader(`{"name":"a"}`))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != `{"name":"a","age":0,"roles":null}` {
+			t.Errorf("%s: unexpected response %d %q", contentType, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestFormCodec(t *testing.T) {
+	var values url.Values
+	err := dispatch.FormCodec{}.Unmarshal([]byte("a=1&a=2&b=3"), &values)
+	if err != nil || len(values["a"]) != 2 || values.Get("b") != "3" {
+		t.Errorf("Unexpected result %v, %v", values, err)
+	}
+	out, err := dispatch.FormCodec{}.Marshal(map[string]string{"x": "a b"})
+	if err != nil || string(out) != "x=a+b" {
+		t.Errorf("Unexpected result %q, %v", out, err)
+	}
+	if _, err = (dispatch.FormCodec{}).Marshal([]int{1}); err == nil {
+		t.Error("Expected error encoding a slice as a form")
+	}
+
+	// An embedded Response is not part of the body
+	created := struct {
+		dispatch.Response
+		ID string `form:"id"`
+	}{ID: "42"}
+	created.SetStatus(201)
+	out, err = dispatch.FormCodec{}.Marshal(created)
+	if err != nil || string(out) != "id=42" {
+		t.Errorf("Unexpected result %q, %v", out, err)
+	}
+}
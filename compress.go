@@ -0,0 +1,249 @@
+package dispatch
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// CompressionConfig enables compression of response bodies with brotli or
+// gzip, as negotiated by the Accept-Encoding header of each request. Brotli is
+// preferred if the client accepts both equally.
+type CompressionConfig struct {
+	// MinSize is the size, in bytes, below which response bodies are not
+	// compressed. If zero, 1024 is used. Streamed responses are compressed
+	// regardless of their size.
+	MinSize int
+
+	// ContentTypes lists the media types to compress, such as
+	// "application/json". An entry such as "text/*" matches every subtype. If
+	// empty, JSON, XML, JavaScript, SVG and text types are compressed.
+	ContentTypes []string
+}
+
+var defaultCompressibleTypes = []string{
+	"text/*",
+	"application/json",
+	"application/x-ndjson",
+	"application/xml",
+	"application/javascript",
+	"application/x-www-form-urlencoded",
+	"image/svg+xml",
+}
+
+// compressible reports whether responses with a Content-Type header of
+// contentType are compressed.
+func (c *CompressionConfig) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	types := c.ContentTypes
+	if len(types) == 0 {
+		types = defaultCompressibleTypes
+	}
+	for _, t := range types {
+		if mediaTypeMatches(t, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding returns the content coding preferred by an Accept-Encoding
+// header, "br" or "gzip", or "" if neither is accepted.
+func negotiateEncoding(acceptEncoding string) string {
+	q := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value := 1.0
+		if qs, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if value, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+		q[name] = value
+	}
+	quality := func(coding string) float64 {
+		if v, ok := q[coding]; ok {
+			return v
+		}
+		return q["*"]
+	}
+	br, gz := quality("br"), quality("gzip")
+	switch {
+	case br > 0 && br >= gz:
+		return "br"
+	case gz > 0:
+		return "gzip"
+	}
+	return ""
+}
+
+// encoder is a compressing writer.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+var (
+	gzipPool   = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	brotliPool = sync.Pool{New: func() interface{} { return brotli.NewWriterLevel(nil, 4) }}
+)
+
+// compressWriter is a ResponseWriter that compresses the response body with
+// the negotiated encoding. The first MinSize bytes are held back, so that
+// small responses can be sent uncompressed.
+//
+// Responses to HEAD requests have no body, so whether they are marked as
+// compressed is decided by their Content-Length instead, to give them the
+// same headers as the response to a GET request.
+type compressWriter struct {
+	http.ResponseWriter
+	config   *CompressionConfig
+	encoding string
+	head     bool
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     encoder
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided || status < http.StatusOK {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if cw.status == 0 {
+		cw.status = status
+	}
+	if cw.head {
+		// Responses without a Content-Length are streamed, and so are
+		// compressed regardless of their size
+		size, err := strconv.Atoi(cw.Header().Get("Content-Length"))
+		cw.decide(err != nil || size >= cw.minSize())
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.minSize() {
+			return len(b), nil
+		}
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// decide writes the status and headers of the response, compressing the body
+// if compress is set and the response is compressible, followed by any data
+// that was held back.
+func (cw *compressWriter) decide(compress bool) error {
+	cw.decided = true
+	header := cw.Header()
+	compress = compress && cw.encoding != "" &&
+		cw.status != http.StatusNoContent && cw.status != http.StatusPartialContent && cw.status != http.StatusNotModified &&
+		header.Get("Content-Encoding") == "" && cw.config.compressible(header.Get("Content-Type"))
+	if compress {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", cw.encoding)
+		// The compressed body differs byte for byte from the one the ETag was
+		// computed for, so the tag can only be a weak validator
+		if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			header.Set("ETag", "W/"+etag)
+		}
+		switch {
+		case cw.head:
+			// There is no body to compress
+		case cw.encoding == "br":
+			w := brotliPool.Get().(*brotli.Writer)
+			w.Reset(cw.ResponseWriter)
+			cw.enc = w
+		default:
+			w := gzipPool.Get().(*gzip.Writer)
+			w.Reset(cw.ResponseWriter)
+			cw.enc = w
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := cw.Write(buf)
+	return err
+}
+
+// Flush implements http.Flusher. Responses that are flushed before MinSize
+// bytes have been written are treated as streams, and compressed regardless
+// of their size.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		cw.decide(true)
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Close writes any data that was held back, and finishes the compressed
+// stream.
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if cw.status == 0 {
+			return nil
+		}
+		if err := cw.decide(len(cw.buf) >= cw.minSize()); err != nil {
+			return err
+		}
+	}
+	if cw.enc == nil {
+		return nil
+	}
+	err := cw.enc.Close()
+	switch enc := cw.enc.(type) {
+	case *gzip.Writer:
+		gzipPool.Put(enc)
+	case *brotli.Writer:
+		brotliPool.Put(enc)
+	}
+	cw.enc = nil
+	return err
+}
+
+// minSize returns the size below which response bodies are not compressed.
+func (cw *compressWriter) minSize() int {
+	if cw.config.MinSize == 0 {
+		return 1024
+	}
+	return cw.config.MinSize
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,171 @@
+package dispatch_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/olafal0/dispatch"
+)
+
+type taggedText struct {
+	dispatch.Response
+	Text string `json:"text"`
+}
+
+func TestCompression(t *testing.T) {
+	large := strings.Repeat("a", 2000)
+	api := &dispatch.API{Compression: &dispatch.CompressionConfig{}}
+	api.AddEndpoint("GET/large", func() string { return large })
+	api.AddEndpoint("GET/small", func() string { return "small" })
+	api.AddEndpoint("GET/image", func() dispatch.File {
+		return dispatch.File{Content: strings.NewReader(large), ContentType: "image/png"}
+	})
+	api.AddEndpoint("GET/count", func() <-chan int {
+		ch := make(chan int, 3)
+		ch <- 1
+		ch <- 2
+		ch <- 3
+		close(ch)
+		return ch
+	})
+	api.AddEndpoint("GET/uncompressed", func() string { return large }).DisableCompression = true
+	api.AddEndpoint("GET/tagged", func() taggedText {
+		out := taggedText{Text: large}
+		out.SetETag("v1")
+		return out
+	})
+
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		return rec
+	}
+	want := `"` + large + `"`
+
+	rec := get("/large", "gzip, deflate")
+	if ce := rec.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Unexpected Content-Encoding %q", ce)
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != "" {
+		t.Errorf("Unexpected Content-Length %q", cl)
+	}
+	if vary := rec.Header().Values("Vary"); !contains(vary, "Accept-Encoding") {
+		t.Errorf("Unexpected Vary %q", vary)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(zr); string(body) != want {
+		t.Errorf("Unexpected body %q", body)
+	}
+
+	rec = get("/large", "gzip;q=0.8, br")
+	if ce := rec.Header().Get("Content-Encoding"); ce != "br" {
+		t.Fatalf("Unexpected Content-Encoding %q", ce)
+	}
+	if body, _ := io.ReadAll(brotli.NewReader(rec.Body)); string(body) != want {
+		t.Errorf("Unexpected body %q", body)
+	}
+
+	for _, tc := range []struct {
+		path, acceptEncoding string
+	}{
+		{"/large", ""},
+		{"/large", "br;q=0, gzip;q=0"},
+		{"/large", "identity"},
+		{"/small", "gzip"},
+		{"/uncompressed", "gzip"},
+	} {
+		rec := get(tc.path, tc.acceptEncoding)
+		if ce := rec.Header().Get("Content-Encoding"); ce != "" {
+			t.Errorf("%s with %q: unexpected Content-Encoding %q", tc.path, tc.acceptEncoding, ce)
+		}
+		if cl := rec.Header().Get("Content-Length"); cl == "" {
+			t.Errorf("%s with %q: missing Content-Length", tc.path, tc.acceptEncoding)
+		}
+		if rec.Code != http.StatusOK || rec.Body.String() != want && tc.path != "/small" {
+			t.Errorf("%s with %q: unexpected response %d %q", tc.path, tc.acceptEncoding, rec.Code, rec.Body.String())
+		}
+	}
+
+	// HEAD responses have the same headers as GET responses
+	for _, path := range []string{"/large", "/small", "/image", "/count"} {
+		getRec := get(path, "gzip")
+		req := httptest.NewRequest("HEAD", path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		for _, name := range []string{"Content-Encoding", "Content-Length", "Content-Type", "Vary"} {
+			if got, want := rec.Header().Values(name), getRec.Header().Values(name); strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("HEAD %s: %s is %q, GET has %q", path, name, got, want)
+			}
+		}
+		if rec.Code != getRec.Code || rec.Body.Len() != 0 {
+			t.Errorf("HEAD %s: unexpected response %d %q", path, rec.Code, rec.Body.String())
+		}
+	}
+
+	// Strong ETags are weakened when the body is compressed
+	rec = get("/tagged", "gzip")
+	if ce, etag := rec.Header().Get("Content-Encoding"), rec.Header().Get("ETag"); ce != "gzip" || etag != `W/"v1"` {
+		t.Errorf("Unexpected compressed ETag %q %q", ce, etag)
+	}
+	rec = get("/tagged", "")
+	if etag := rec.Header().Get("ETag"); etag != `"v1"` {
+		t.Errorf("Unexpected ETag %q", etag)
+	}
+
+	rec = get("/image", "gzip")
+	if ce := rec.Header().Get("Content-Encoding"); ce != "" || rec.Body.String() != large {
+		t.Errorf("Unexpected image response %q %q", ce, rec.Body.String())
+	}
+
+	// Streams are compressed regardless of size, and flushed after each item
+	rec = get("/count", "gzip")
+	if ce := rec.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Unexpected Content-Encoding %q", ce)
+	}
+	if !rec.Flushed {
+		t.Error("Stream was not flushed")
+	}
+	zr, err = gzip.NewReader(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(zr); string(body) != "1\n2\n3\n" {
+		t.Errorf("Unexpected stream %q", body)
+	}
+
+	// Without Compression, Accept-Encoding is ignored
+	api.Compression = nil
+	rec = get("/large", "gzip")
+	if ce := rec.Header().Get("Content-Encoding"); ce != "" || rec.Body.String() != want {
+		t.Errorf("Unexpected response %q %q", ce, rec.Body.String())
+	}
+	if vary := rec.Header().Values("Vary"); contains(vary, "Accept-Encoding") {
+		t.Errorf("Unexpected Vary %q", vary)
+	}
+	if rec.Code != http.StatusOK {
+		t.Errorf("Unexpected status %d", rec.Code)
+	}
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package dispatch
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// context returns the context.Context of the call.
+func (c Context) context() context.Context {
+	if c.ctx != nil {
+		return c.ctx
+	}
+	if c.Request != nil {
+		return c.Request.Context()
+	}
+	return context.Background()
+}
+
+// Deadline implements context.Context.
+func (c Context) Deadline() (deadline time.Time, ok bool) {
+	return c.context().Deadline()
+}
+
+// Done implements context.Context. The channel is closed when the client
+// disconnects, or when the endpoint's Timeout expires.
+func (c Context) Done() <-chan struct{} {
+	return c.context().Done()
+}
+
+// Err implements context.Context.
+func (c Context) Err() error {
+	return c.context().Err()
+}
+
+// Value implements context.Context.
+func (c Context) Value(key interface{}) interface{} {
+	return c.context().Value(key)
+}
+
+// withTimeout wraps next so that its context is canceled after timeout. If
+// next has not returned by then, ErrorTimeout is returned without waiting for
+// it. Until next returns, its writes to the response are held back, and any
+// after the timeout are discarded. If next had already started writing the
+// response, the Context records that it was written, so that the error is only
+// logged.
+func withTimeout(timeout time.Duration, next Handler) Handler {
+	return func(in *EndpointInput) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(in.Ctx.context(), timeout)
+		defer cancel()
+
+		callCtx := *in.Ctx
+		callCtx.ctx = ctx
+		// Whether the handler wrote the response is only passed on if it
+		// returns in time, since its writes are discarded otherwise
+		callCtx.written = new(atomic.Bool)
+		if callCtx.Request != nil {
+			callCtx.Request = callCtx.Request.WithContext(ctx)
+		}
+		var tw *timeoutWriter
+		if callCtx.Writer != nil {
+			tw = &timeoutWriter{w: callCtx.Writer, header: callCtx.Writer.Header().Clone()}
+			callCtx.Writer = tw
+		}
+		callIn := &EndpointInput{in.Method, in.Path, &callCtx, in.Input}
+
+		type result struct {
+			out interface{}
+			err error
+		}
+		done := make(chan result, 1)
+		go func() {
+			var res result
+			defer func() { done <- res }()
+			defer recoverInternal(&res.out, &res.err)
+			res.out, res.err = next(callIn)
+		}()
+
+		select {
+		case res := <-done:
+			if tw != nil {
+				tw.finish()
+			}
+			// Changes that hooks made to the Context are kept, without the
+			// timeout
+			written := callCtx.responseWritten()
+			callCtx.ctx, callCtx.Writer, callCtx.written = in.Ctx.ctx, in.Ctx.Writer, in.Ctx.written
+			if callCtx.Request != nil && in.Ctx.Request != nil {
+				callCtx.Request = callCtx.Request.WithContext(in.Ctx.Request.Context())
+			}
+			*in.Ctx = callCtx
+			if written {
+				in.Ctx.setResponseWritten()
+			}
+			return res.out, res.err
+		case <-ctx.Done():
+			err := ctx.Err()
+			if err == context.DeadlineExceeded {
+				err = ErrorTimeout
+			}
+			if tw != nil && !tw.timeout() {
+				// The handler already started writing the response, so the
+				// error can only be logged
+				in.Ctx.setResponseWritten()
+			}
+			return nil, err
+		}
+	}
+}
+
+// timeoutWriter is the ResponseWriter given to handlers with a timeout. It
+// keeps its own header map until the handler writes the response or returns,
+// so that the handler can't race with the writing of a timeout error.
+type timeoutWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	mu       sync.Mutex
+	timedOut bool
+	wrote    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.copyHeader()
+	return tw.w.Write(b)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.copyHeader()
+	tw.w.WriteHeader(status)
+}
+
+// Hijack implements http.Hijacker, for mounted handlers that take over the
+// connection. The response then counts as written.
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	tw.copyHeader()
+	return http.NewResponseController(tw.w).Hijack()
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.w
+}
+
+// copyHeader copies the handler's headers to the underlying ResponseWriter
+// before the response is first written.
+func (tw *timeoutWriter) copyHeader() {
+	if tw.wrote {
+		return
+	}
+	tw.wrote = true
+	dst := tw.w.Header()
+	for name := range dst {
+		if _, ok := tw.header[name]; !ok {
+			delete(dst, name)
+		}
+	}
+	for name, values := range tw.header {
+		dst[name] = values
+	}
+}
+
+// finish copies the handler's headers after it has returned, for handlers
+// that set headers without writing a response.
+func (tw *timeoutWriter) finish() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.copyHeader()
+}
+
+// timeout discards any further writes from the handler. It reports false if
+// the handler had already started writing the response.
+func (tw *timeoutWriter) timeout() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.timedOut = true
+	return !tw.wrote
+}
@@ -0,0 +1,122 @@
+package dispatch_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/olafal0/dispatch"
+)
+
+func TestTimeout(t *testing.T) {
+	api := &dispatch.API{}
+	canceled := make(chan error, 1)
+	slow := api.AddEndpoint("GET/slow", func(ctx *dispatch.Context) string {
+		select {
+		case <-ctx.Done():
+			canceled <- ctx.Err()
+		case <-time.After(time.Second):
+		}
+		return "done"
+	})
+	slow.Timeout = 10 * time.Millisecond
+	fast := api.AddEndpoint("GET/fast", func(ctx *dispatch.Context) string {
+		ctx.Writer.Header().Set("X-Fast", "yes")
+		if _, ok := ctx.Deadline(); !ok {
+			return "no deadline"
+		}
+		return "done"
+	})
+	fast.Timeout = time.Second
+
+	rec := doRequest(api.ServeHTTP, "GET", "/slow", "")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected timeout, got %d %q", rec.Code, rec.Body.String())
+	}
+	if body := decodeErrorBody(t, rec); body.Error.Code != "timeout" {
+		t.Errorf("Unexpected error code %q", body.Error.Code)
+	}
+	select {
+	case err := <-canceled:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Unexpected context error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Handler context was not canceled")
+	}
+
+	rec = doRequest(api.ServeHTTP, "GET", "/fast", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != `"done"` {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("X-Fast") != "yes" {
+		t.Error("Header set by handler was not written")
+	}
+}
+
+func TestTimeoutAfterWrite(t *testing.T) {
+	var requestID string
+	api := &dispatch.API{
+		Middleware: []dispatch.Middleware{func(next dispatch.Handler) dispatch.Handler {
+			return func(in *dispatch.EndpointInput) (interface{}, error) {
+				out, err := next(in)
+				requestID = in.Ctx.RequestID
+				return out, err
+			}
+		}},
+	}
+	partial := api.AddEndpoint("GET/partial", func(ctx *dispatch.Context) string {
+		ctx.Writer.Write([]byte("partial"))
+		<-ctx.Done()
+		return "done"
+	})
+	partial.Timeout = 10 * time.Millisecond
+	tagged := api.AddEndpoint("GET/tagged", func() string { return "done" }, func(in *dispatch.EndpointInput) (*dispatch.EndpointInput, error) {
+		in.Ctx.RequestID = "tagged"
+		return in, nil
+	})
+	tagged.Timeout = time.Second
+
+	// The error is not appended to a response that was already started
+	rec := doRequest(api.ServeHTTP, "GET", "/partial", "")
+	if rec.Body.String() != "partial" {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	// Changes hooks make to the Context are kept
+	doRequest(api.ServeHTTP, "GET", "/tagged", "")
+	if requestID != "tagged" {
+		t.Errorf("Expected request ID set by hook, got %q", requestID)
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	api := &dispatch.API{}
+	api.AddEndpoint("GET/wait", func(ctx *dispatch.Context) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+
+	reqCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/wait", nil).WithContext(reqCtx)
+	_, err := api.Call("GET", "/wait", &dispatch.Context{Request: req}, nil)
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	// Calls canceled by a client disconnect are not server errors
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	if rec.Code != 499 || decodeErrorBody(t, rec).Error.Code != "client_closed_request" {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	// A Context without a request is never canceled
+	var ctx context.Context = &dispatch.Context{}
+	if ctx.Done() != nil || ctx.Err() != nil {
+		t.Error("Expected background context")
+	}
+}
@@ -0,0 +1,114 @@
+package dispatch
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig is a cross-origin resource sharing policy, which controls which
+// web pages may call the API from a browser.
+type CORSConfig struct {
+	// AllowedOrigins lists the origins, such as "https://example.com", that may
+	// make cross-origin requests. An entry of "*" allows any origin.
+	AllowedOrigins []string
+
+	// AllowOriginFunc, if set, is called for origins not in AllowedOrigins, and
+	// allows the origin if it returns true.
+	AllowOriginFunc func(origin string) bool
+
+	// AllowCredentials allows requests to include credentials, such as the
+	// cookies used by the auth package. Credentials are only allowed for
+	// origins listed explicitly or allowed by AllowOriginFunc: origins that
+	// are only allowed by "*" may make requests without credentials.
+	AllowCredentials bool
+
+	// AllowedHeaders lists the request headers that cross-origin requests may
+	// use. An entry of "*" allows whichever headers are requested.
+	AllowedHeaders []string
+
+	// ExposedHeaders lists the response headers that browsers may expose to
+	// the calling page.
+	ExposedHeaders []string
+
+	// MaxAge is how long browsers may cache the result of a preflight request.
+	// If zero, the browser's default is used.
+	MaxAge time.Duration
+}
+
+// defaultCORS is the policy used when API.CORS is nil.
+var defaultCORS = &CORSConfig{
+	AllowedOrigins: []string{"*"},
+	AllowedHeaders: []string{"Content-Type", "Authorization"},
+}
+
+// allowOrigin returns the value of the Access-Control-Allow-Origin header for
+// a request from origin, or "" if the origin is not allowed. Origins that are
+// only allowed by a "*" entry get "*", so they never receive credentials.
+func (c *CORSConfig) allowOrigin(origin string) string {
+	wildcard := false
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			wildcard = true
+		} else if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	if origin != "" && c.AllowOriginFunc != nil && c.AllowOriginFunc(origin) {
+		return origin
+	}
+	if wildcard {
+		return "*"
+	}
+	return ""
+}
+
+// onlyWildcard reports whether every origin is allowed the same way, by a "*"
+// entry, so that responses don't vary by origin.
+func (c *CORSConfig) onlyWildcard() bool {
+	return len(c.AllowedOrigins) == 1 && c.AllowedOrigins[0] == "*" && c.AllowOriginFunc == nil
+}
+
+// setHeaders sets the CORS headers that apply to every response, and reports
+// whether the request's origin is allowed.
+func (c *CORSConfig) setHeaders(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	allowed := c.allowOrigin(origin)
+	if !c.onlyWildcard() {
+		w.Header().Add("Vary", "Origin")
+	}
+	if allowed == "" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", allowed)
+	// Browsers reject credentials for "*", and echoing the origin instead would
+	// let any site make authenticated requests
+	if c.AllowCredentials && allowed != "*" {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(c.ExposedHeaders) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+	}
+	return true
+}
+
+// setPreflightHeaders sets the headers of a response to a preflight request,
+// given the methods allowed for the requested path.
+func (c *CORSConfig) setPreflightHeaders(w http.ResponseWriter, r *http.Request, methods []string) {
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	headers := strings.Join(c.AllowedHeaders, ", ")
+	for _, h := range c.AllowedHeaders {
+		if h == "*" {
+			headers = r.Header.Get("Access-Control-Request-Headers")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			break
+		}
+	}
+	if headers != "" {
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+	}
+	if c.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+}
@@ -0,0 +1,130 @@
+package dispatch_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/olafal0/dispatch"
+)
+
+func corsRequest(handler http.HandlerFunc, method, path, origin string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if method == "OPTIONS" {
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "Content-Type, X-Custom")
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestDefaultCORS(t *testing.T) {
+	api := &dispatch.API{}
+	api.AddEndpoint("GET/users/{id}", func() {})
+	api.AddEndpoint("DELETE/users/{id}", func() {})
+	handler := api.GetHandler()
+
+	rec := corsRequest(handler, "OPTIONS", "/users/1", "https://example.com")
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", rec.Code)
+	}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "DELETE, GET, HEAD, OPTIONS",
+		"Access-Control-Allow-Headers": "Content-Type, Authorization",
+	}
+	for header, value := range expected {
+		if got := rec.Header().Get(header); got != value {
+			t.Errorf("Expected %s %q, got %q", header, value, got)
+		}
+	}
+
+	rec = corsRequest(handler, "OPTIONS", "/none", "https://example.com")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", rec.Code)
+	}
+}
+
+func TestCORSConfig(t *testing.T) {
+	api := &dispatch.API{
+		CORS: &dispatch.CORSConfig{
+			AllowedOrigins: []string{"https://app.example.com"},
+			AllowOriginFunc: func(origin string) bool {
+				return origin == "http://localhost:3000"
+			},
+			AllowCredentials: true,
+			AllowedHeaders:   []string{"*"},
+			ExposedHeaders:   []string{"X-Request-Id"},
+			MaxAge:           10 * time.Minute,
+		},
+	}
+	api.AddEndpoint("POST/items", func() {})
+	handler := api.GetHandler()
+
+	for _, origin := range []string{"https://app.example.com", "http://localhost:3000"} {
+		rec := corsRequest(handler, "OPTIONS", "/items", origin)
+		expected := map[string]string{
+			"Access-Control-Allow-Origin":      origin,
+			"Access-Control-Allow-Credentials": "true",
+			"Access-Control-Allow-Methods":     "POST, OPTIONS",
+			"Access-Control-Allow-Headers":     "Content-Type, X-Custom",
+			"Access-Control-Max-Age":           "600",
+		}
+		for header, value := range expected {
+			if got := rec.Header().Get(header); got != value {
+				t.Errorf("%s: expected %s %q, got %q", origin, header, value, got)
+			}
+		}
+
+		rec = corsRequest(handler, "POST", "/items", origin)
+		if got := rec.Header().Get("Access-Control-Expose-Headers"); got != "X-Request-Id" {
+			t.Errorf("%s: unexpected exposed headers %q", origin, got)
+		}
+		if got := rec.Header().Get("Vary"); got != "Origin" {
+			t.Errorf("%s: unexpected Vary %q", origin, got)
+		}
+	}
+
+	rec := corsRequest(handler, "OPTIONS", "/items", "https://evil.example.com")
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Unexpected allowed origin %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "" {
+		t.Errorf("Unexpected allowed methods %q", got)
+	}
+}
+
+func TestCORSWildcardCredentials(t *testing.T) {
+	api := &dispatch.API{
+		CORS: &dispatch.CORSConfig{
+			AllowedOrigins:   []string{"https://app.example.com", "*"},
+			AllowCredentials: true,
+		},
+	}
+	api.AddEndpoint("GET/me", func() {})
+	handler := api.GetHandler()
+
+	rec := corsRequest(handler, "GET", "/me", "https://evil.example.com")
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Expected wildcard origin, got %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("Unexpected credentials for wildcard origin: %q", got)
+	}
+
+	rec = corsRequest(handler, "GET", "/me", "https://app.example.com")
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Expected listed origin, got %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Expected credentials for listed origin, got %q", got)
+	}
+	if got := rec.Header().Get("Vary"); got != "Origin" {
+		t.Errorf("Unexpected Vary %q", got)
+	}
+}
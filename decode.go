@@ -0,0 +1,188 @@
+package dispatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// DecodeOptions control how request bodies are decoded into handler inputs.
+// The zero value decodes bodies the same way as json.Unmarshal.
+type DecodeOptions struct {
+	// DisallowUnknownFields rejects JSON objects with keys that don't match
+	// any field of the input struct.
+	DisallowUnknownFields bool
+
+	// UseNumber decodes JSON numbers into interface{} values as json.Number
+	// instead of float64.
+	UseNumber bool
+
+	// AllowEmptyBody decodes an empty request body as the zero value of the
+	// input, instead of rejecting it.
+	AllowEmptyBody bool
+}
+
+// decodeOptions returns the options used for an endpoint.
+func (api *API) decodeOptions(endpoint *Endpoint) *DecodeOptions {
+	if endpoint.DecodeOptions != nil {
+		return endpoint.DecodeOptions
+	}
+	if api.DecodeOptions != nil {
+		return api.DecodeOptions
+	}
+	return &DecodeOptions{}
+}
+
+// decodeJSON decodes a JSON value with the given options. Errors wrap
+// ErrorBadRequest, and are described with the path of the field at fault.
+func decodeJSON(data []byte, dst interface{}, opts *DecodeOptions) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if opts.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if opts.UseNumber {
+		dec.UseNumber()
+	}
+	if err := dec.Decode(dst); err != nil {
+		return jsonDecodeError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("%w: invalid JSON: unexpected data after the value", ErrorBadRequest)
+	}
+	return nil
+}
+
+// jsonDecodeError converts an error from a json.Decoder to a bad request.
+func jsonDecodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Errorf("%w: cannot use JSON %s as %s", ErrorBadRequest, typeErr.Value, typeErr.Type)
+		}
+		return fieldError(typeErr.Field, fmt.Sprintf("cannot use JSON %s as %s", typeErr.Value, typeErr.Type))
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("%w: invalid JSON at offset %d: %v", ErrorBadRequest, syntaxErr.Offset, err)
+	case err == io.EOF:
+		return fmt.Errorf("%w: request body is empty", ErrorBadRequest)
+	case err == io.ErrUnexpectedEOF:
+		return fmt.Errorf("%w: invalid JSON: unexpected end of input", ErrorBadRequest)
+	}
+	// The decoder has no error type for unknown fields
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		if unquoted, err := strconv.Unquote(name); err == nil {
+			name = unquoted
+		}
+		return fieldError(name, "unknown field")
+	}
+	return fmt.Errorf("%w: %v", ErrorBadRequest, err)
+}
+
+// fieldError returns a bad request error for the field at path, such as
+// "address.city", which is also included in the error's details.
+func fieldError(path, message string) error {
+	httpErr := ErrorBadRequest.(*HTTPError).WithDetails(map[string]string{"field": path})
+	return fmt.Errorf("%w: field %s: %s", httpErr, path, message)
+}
+
+// hasRequiredFields reports whether t, or a struct type nested in it, has a
+// field tagged with `required:"true"`.
+func hasRequiredFields(t reflect.Type) bool {
+	return hasRequiredFieldsVisited(t, map[reflect.Type]bool{})
+}
+
+func hasRequiredFieldsVisited(t reflect.Type, visited map[reflect.Type]bool) bool {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || visited[t] {
+		return false
+	}
+	visited[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		if field.Tag.Get("required") == "true" || hasRequiredFieldsVisited(field.Type, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRequired returns an error for the first field tagged with
+// `required:"true"` that has its zero value, including fields of nested
+// structs. The path of the field is built from prefix and the JSON names of
+// the fields, or the names of their bindings.
+func checkRequired(v reflect.Value, prefix string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return checkRequired(v.Elem(), prefix)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := checkRequired(v.Index(i), fmt.Sprintf("%s[%d]", prefix, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		path := prefix
+		// Fields of embedded structs are promoted, as in JSON
+		if !field.Anonymous {
+			name, ok := requiredFieldName(field)
+			if !ok {
+				continue
+			}
+			if prefix != "" {
+				path = prefix + "." + name
+			} else {
+				path = name
+			}
+		}
+		if field.Tag.Get("required") == "true" && v.Field(i).IsZero() {
+			return fieldError(path, "is required")
+		}
+		if err := checkRequired(v.Field(i), path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requiredFieldName returns the name of a field in error messages, or false if
+// the field is ignored by JSON and has no binding.
+func requiredFieldName(field reflect.StructField) (string, bool) {
+	for _, tag := range bindingTags {
+		if name := field.Tag.Get(tag); name != "" && name != "-" {
+			return name, true
+		}
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return "", false
+	}
+	if name == "" {
+		name = field.Name
+	}
+	return name, true
+}
@@ -0,0 +1,94 @@
+package dispatch_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/olafal0/dispatch"
+)
+
+type decodeAddress struct {
+	City string `json:"city" required:"true"`
+}
+
+type decodeInput struct {
+	Name      string          `json:"name" required:"true"`
+	Age       *int            `json:"age" required:"true"`
+	Limit     int             `query:"limit"`
+	Addresses []decodeAddress `json:"addresses"`
+	Extra     interface{}     `json:"extra"`
+}
+
+func TestDecodeErrors(t *testing.T) {
+	api := &dispatch.API{}
+	api.AddEndpoint("POST/users", func(in decodeInput) decodeInput { return in })
+
+	tests := []struct {
+		path, body, field string
+		status            int
+	}{
+		{"/users", `{"name":"a","age":0}`, "", http.StatusOK},
+		{"/users", `{"name":"a","age":"old"}`, "age", http.StatusBadRequest},
+		{"/users", `{"name":"a","age":1,"addresses":[{"city":"x"},{}]}`, "addresses[1].city", http.StatusBadRequest},
+		{"/users", `{"age":1}`, "name", http.StatusBadRequest},
+		{"/users", `{"name":"a"}`, "age", http.StatusBadRequest},
+		{"/users", `{"name":"a","age":1,"nmae":"b"}`, "", http.StatusOK},
+		{"/users", `{"name":`, "", http.StatusBadRequest},
+		{"/users", `{"name":"a","age":1} {}`, "", http.StatusBadRequest},
+		{"/users", ``, "", http.StatusBadRequest},
+		{"/users?limit=x", `{"name":"a","age":1}`, "", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		rec := doRequest(api.ServeHTTP, "POST", test.path, test.body)
+		if rec.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d %q", test.body, test.status, rec.Code, rec.Body.String())
+			continue
+		}
+		if test.field == "" {
+			continue
+		}
+		body := decodeErrorBody(t, rec)
+		details, _ := body.Error.Details.(map[string]interface{})
+		if details["field"] != test.field {
+			t.Errorf("%s: expected field %q, got %v (%s)", test.body, test.field, body.Error.Details, body.Error.Message)
+		}
+	}
+}
+
+func TestDecodeOptions(t *testing.T) {
+	api := &dispatch.API{DecodeOptions: &dispatch.DecodeOptions{DisallowUnknownFields: true, UseNumber: true}}
+	api.AddEndpoint("POST/users", func(in decodeInput) decodeInput { return in })
+	api.AddEndpoint("POST/search", func(in decodeInput) decodeInput { return in }).DecodeOptions = &dispatch.DecodeOptions{AllowEmptyBody: true}
+	api.AddEndpoint("POST/number", func(in decodeInput) string {
+		_, ok := in.Extra.(json.Number)
+		if ok {
+			return "number"
+		}
+		return "other"
+	})
+
+	rec := doRequest(api.ServeHTTP, "POST", "/users", `{"name":"a","age":1,"nmae":"b"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected unknown field error, got %d %q", rec.Code, rec.Body.String())
+	}
+	if body := decodeErrorBody(t, rec); body.Error.Message != "Bad request: field nmae: unknown field" {
+		t.Errorf("Unexpected message %q", body.Error.Message)
+	}
+
+	rec = doRequest(api.ServeHTTP, "POST", "/number", `{"name":"a","age":1,"extra":12}`)
+	if rec.Body.String() != `"number"` {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	// Required fields are still checked for empty bodies
+	rec = doRequest(api.ServeHTTP, "POST", "/search", "")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected required field error, got %d %q", rec.Code, rec.Body.String())
+	}
+	api.AddEndpoint("POST/optional", func(in struct{ Q string }) string { return "q=" + in.Q }).DecodeOptions = &dispatch.DecodeOptions{AllowEmptyBody: true}
+	rec = doRequest(api.ServeHTTP, "POST", "/optional", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != `"q="` {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -1,64 +1,302 @@
 package dispatch
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 // GetHandler returns a handler function suitable for use in http.HandleFunc.
 // For example:
 //
-//  	http.HandleFunc("/", api.GetHandler())
-//  	log.Fatal(http.ListenAndServe(":8000", nil))
+//	http.HandleFunc("/", api.GetHandler())
+//	log.Fatal(http.ListenAndServe(":8000", nil))
 //
-// The provided handler takes care of access control headers, CORS requests,
-// JSON marshalling, and error handling.
+// The provided handler takes care of access control headers, CORS requests
+// according to API.CORS, encoding with API.Codecs, and error handling. Errors
+// are always written as a JSON body in the format {"error": {"code": "...",
+// "message": "..."}}, with the status code of the HTTPError in the error's
+// chain, or 500 if there is none. OPTIONS requests are answered with the
+// methods registered for the path, and requests with any other unregistered
+// method receive a 405. HEAD requests are answered by the GET endpoint for the
+// path, without the body. Request bodies larger than API.MaxBodySize receive a
+// 413.
+//
+// Outputs that are channels, or iterator functions of the form
+// func(yield func(T) bool) or func(yield func(T, error) bool), are streamed
+// as newline-delimited JSON, or as
+// Server-Sent Events if the request accepts text/event-stream. Each value is
+// flushed as it is received, and the stream stops when the client disconnects
+// or an error is received. Values of type Event set the fields of their
+// Server-Sent Event.
+//
+// If API.Compression is set, responses are compressed with brotli or gzip
+// according to the Accept-Encoding header of the request, including streamed
+// responses.
+//
+// GET and HEAD requests with an If-None-Match header that matches the ETag of
+// the response, or an If-Modified-Since header that is not before its
+// Last-Modified header, receive 304 Not Modified without a body. Handlers can
+// set these headers with Response.SetETag and Response.SetLastModified, and
+// API.ETags computes an ETag for responses that have none.
 func (api *API) GetHandler() func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		wroteHeader := 200
-		wroteStatus := http.StatusText(200)
-		startTime := time.Now()
-		defer func() {
-			log.Printf("%v %s%s - %d %s", time.Since(startTime), r.Method, r.URL.Path, wroteHeader, wroteStatus)
-		}()
-		writeError := func(w http.ResponseWriter, error string, code int) {
-			wroteHeader = code
-			wroteStatus = http.StatusText(code)
-			http.Error(w, error, code)
+	return api.ServeHTTP
+}
+
+// ServeHTTP implements http.Handler, so that an API can be used anywhere an
+// http.Handler is accepted, and wrapped with standard net/http middleware. It
+// behaves the same as the handler returned by GetHandler.
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+	startTime := time.Now()
+	requestID := getRequestID(r)
+	w.Header().Set("X-Request-Id", requestID)
+	defer func() {
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		log.Printf("%v %s%s - %d %s (request %s)", time.Since(startTime), r.Method, r.URL.Path, status, http.StatusText(status), requestID)
+	}()
+	writeError := func(w http.ResponseWriter, err error) {
+		httpErr, body := api.encodeError(err, requestID)
+		for name, values := range httpErr.Header {
+			w.Header()[name] = values
 		}
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "PUT, POST, GET, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		writeBody(w, r, httpErr.Status, body)
+	}
+	cors := api.CORS
+	if cors == nil {
+		cors = defaultCORS
+	}
+	originAllowed := cors.setHeaders(w, r)
+	// OPTIONS requests are answered automatically, unless there is an OPTIONS
+	// or AnyMethod endpoint for the path. Preflight requests are answered
+	// automatically if the path has any endpoints for specific methods.
+	preflight := r.Header.Get("Access-Control-Request-Method") != ""
+	var methods []string
+	if r.Method == "OPTIONS" {
+		methods = api.AllowedMethods(r.URL.Path)
+	}
+	if r.Method == "OPTIONS" && (preflight && len(methods) > 0 || !api.hasEndpoint("OPTIONS", r.URL.Path)) {
+		if len(methods) == 0 {
+			writeError(w, ErrorNotFound)
 			return
 		}
-		data, err := ioutil.ReadAll(r.Body)
+		methods = withOptions(methods)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		if preflight && originAllowed {
+			cors.setPreflightHeaders(w, r, methods)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// The body is read before the call, unless the endpoint for the request
+	// reads it itself
+	endpoint, pathVars := api.MatchEndpoint(r.Method, r.URL.Path)
+	if limit := api.maxBodySize(endpoint); limit >= 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	var data []byte
+	if endpoint == nil || !endpoint.handler.streamBody {
+		var err error
+		data, err = ioutil.ReadAll(r.Body)
 		if err != nil {
-			writeError(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
-		ctx := &Context{Request: r, Writer: w}
-		output, err := api.Call(r.Method, r.URL.Path, ctx, data)
+		// Hooks can still change the path to an endpoint that reads the body
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	}
+	// WebSocket handshakes are never compressed, since their connection is
+	// taken over by the handler
+	if api.Compression != nil && (endpoint == nil || !endpoint.DisableCompression) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Header.Get("Upgrade") == "" {
+			cw := &compressWriter{ResponseWriter: w, config: api.Compression, encoding: negotiateEncoding(r.Header.Get("Accept-Encoding")), head: r.Method == http.MethodHead}
+			defer cw.Close()
+			w = cw
+		}
+	}
+	// The response format is chosen before the call, so that requests that
+	// can't be answered have no effect
+	codecs := api.codecs()
+	stream := endpoint != nil && endpoint.handler.stream
+	if len(codecs) > 1 || stream {
+		w.Header().Add("Vary", "Accept")
+	}
+	accept := r.Header.Get("Accept")
+	codec, codecErr := negotiateCodec(codecs, accept)
+	streamIndex, streamErr := negotiate(accept, streamTypes)
+	if stream && streamErr != nil || !stream && codecErr != nil && endpoint != nil && !endpoint.handler.writesResponse && !endpoint.handler.rawOutput {
+		writeError(w, ErrorNotAcceptable)
+		return
+	}
+	ctx := &Context{
+		Request:   r,
+		Writer:    w,
+		RequestID: requestID,
+		written:   new(atomic.Bool),
+		// The call only matches the request again if hooks change its path
+		matched: &routeMatch{r.Method, r.URL.Path, endpoint, pathVars},
+	}
+	output, err := api.Call(r.Method, r.URL.Path, ctx, data)
+	// Hooks and middleware can replace the output of a handler that wrote the
+	// response itself
+	if ctx.responseWritten() {
 		if err != nil {
-			if err == ErrorNotFound {
-				writeError(w, err.Error(), http.StatusNotFound)
-			} else if err == ErrorBadRequest {
-				writeError(w, err.Error(), http.StatusBadRequest)
-			} else {
-				writeError(w, err.Error(), http.StatusInternalServerError)
-			}
+			api.encodeError(err, requestID)
+		}
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if isStreamType(reflect.TypeOf(output)) {
+		if streamErr != nil {
+			writeError(w, streamErr)
 			return
 		}
-		outBytes, err := json.Marshal(output)
-		if err != nil {
-			writeError(w, err.Error(), http.StatusInternalServerError)
+		api.writeStream(w, r, output, streamTypes[streamIndex], requestID)
+		return
+	}
+	if file, ok := rawOutput(output); ok {
+		writeFile(w, r, file)
+		return
+	}
+	if codecErr != nil {
+		writeError(w, codecErr)
+		return
+	}
+	status, done := writeResponse(w, output, ctx.noOutput)
+	if done {
+		return
+	}
+	outBytes, err := codec.Marshal(output)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", codec.ContentType())
+	if status == http.StatusOK {
+		if api.ETags && w.Header().Get("ETag") == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			w.Header().Set("ETag", ETag(outBytes))
+		}
+		if notModified(r, w.Header()) {
+			writeNotModified(w)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(outBytes)
 	}
+	writeBody(w, r, status, outBytes)
+}
+
+// encodeError returns the HTTPError for err, and its JSON error body. Errors
+// with a status of 500 or more are logged.
+func (api *API) encodeError(err error, requestID string) (*HTTPError, []byte) {
+	httpErr := toHTTPError(err, api.HideInternalErrors)
+	if httpErr.Status >= 500 {
+		log.Printf("Error in request %s: %v", requestID, err)
+	}
+	body, _ := json.Marshal(errorBody{errorBodyContent{httpErr.Code, httpErr.Message, httpErr.Details, requestID}})
+	return httpErr, body
+}
+
+// maxBodySize returns the request body limit for an endpoint, which may be
+// nil, or a negative number if there is no limit.
+func (api *API) maxBodySize(endpoint *Endpoint) int64 {
+	limit := api.MaxBodySize
+	if endpoint != nil && endpoint.MaxBodySize != 0 {
+		limit = endpoint.MaxBodySize
+	}
+	if limit == 0 {
+		limit = DefaultMaxBodySize
+	}
+	return limit
+}
+
+// writeBody writes the status and body of a response, along with its
+// Content-Length. The body of a response to a HEAD request is discarded, but
+// its headers are kept.
+func writeBody(w http.ResponseWriter, r *http.Request, status int, body []byte) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// getRequestID returns the request's X-Request-Id header if it is a reasonable
+// request ID, or else a new random ID.
+func getRequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); len(id) > 0 && len(id) <= 64 {
+		valid := true
+		for _, c := range id {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			return id
+		}
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// statusWriter is a ResponseWriter that records the status code of the
+// response, for logging.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher, if the underlying ResponseWriter supports it.
+func (w *statusWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack implements http.Hijacker, if the underlying ResponseWriter supports
+// it.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
@@ -0,0 +1,307 @@
+package dispatch_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/olafal0/dispatch"
+)
+
+type testErrorBody struct {
+	Error struct {
+		Code    string
+		Message string
+		Details interface{}
+	}
+}
+
+func doRequest(handler http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func decodeErrorBody(t *testing.T, rec *httptest.ResponseRecorder) testErrorBody {
+	t.Helper()
+	var body testErrorBody
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Invalid error body %q: %v", rec.Body.String(), err)
+	}
+	return body
+}
+
+func TestHandlerErrors(t *testing.T) {
+	api := &dispatch.API{}
+	api.AddEndpoint("GET/ok", func() string { return "ok" })
+	api.AddEndpoint("GET/conflict", func() error {
+		return fmt.Errorf("saving user: %w", dispatch.ErrorConflict)
+	})
+	api.AddEndpoint("GET/details", func() error {
+		return dispatch.NewHTTPError(http.StatusTeapot, "teapot", "I'm a teapot").WithDetails([]string{"short", "stout"})
+	})
+	api.AddEndpoint("GET/internal", func() error { return errors.New("disk on fire") })
+	handler := api.GetHandler()
+
+	rec := doRequest(handler, "GET", "/ok", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != `"ok"` {
+		t.Errorf("Unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+
+	tests := []struct {
+		path    string
+		status  int
+		code    string
+		message string
+	}{
+		{"/none", http.StatusNotFound, "not_found", "Path not found"},
+		{"/conflict", http.StatusConflict, "conflict", "saving user: Conflict"},
+		{"/details", http.StatusTeapot, "teapot", "I'm a teapot"},
+		{"/internal", http.StatusInternalServerError, "internal", "disk on fire"},
+	}
+	for _, test := range tests {
+		rec := doRequest(handler, "GET", test.path, "")
+		if rec.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.path, test.status, rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: unexpected content type %s", test.path, ct)
+		}
+		body := decodeErrorBody(t, rec)
+		if body.Error.Code != test.code || body.Error.Message != test.message {
+			t.Errorf("%s: unexpected error body %s", test.path, rec.Body.String())
+		}
+	}
+
+	body := decodeErrorBody(t, doRequest(handler, "GET", "/details", ""))
+	if fmt.Sprint(body.Error.Details) != "[short stout]" {
+		t.Errorf("Unexpected details %v", body.Error.Details)
+	}
+}
+
+func TestHTTPErrorMatching(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", dispatch.ErrorNotFound.(*dispatch.HTTPError).WithDetails("x"))
+	if !errors.Is(err, dispatch.ErrorNotFound) {
+		t.Error("Expected error to match ErrorNotFound")
+	}
+	if errors.Is(err, dispatch.ErrorBadRequest) {
+		t.Error("Expected error not to match ErrorBadRequest")
+	}
+	var httpErr *dispatch.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Status != http.StatusNotFound {
+		t.Errorf("Expected 404 HTTPError, got %v", httpErr)
+	}
+}
+
+func TestHideInternalErrors(t *testing.T) {
+	api := &dispatch.API{HideInternalErrors: true}
+	api.AddEndpoint("GET/internal", func() error { return errors.New("sql: connection refused") })
+	api.AddEndpoint("GET/public", func() error { return dispatch.Public(errors.New("Try again later")) })
+	api.AddEndpoint("GET/bad", func() error { return fmt.Errorf("%w: missing name", dispatch.ErrorBadRequest) })
+	api.AddEndpoint("GET/wrapped", func() error {
+		return fmt.Errorf("query %q failed: %v: %w", "SELECT 1", errors.New("connection refused"), dispatch.ErrorInternal)
+	})
+	api.AddEndpoint("GET/canceled", func() error {
+		return fmt.Errorf("query postgres://admin:pw@db/users failed: %w", context.Canceled)
+	})
+	api.AddEndpoint("GET/large", func() error {
+		return fmt.Errorf("reading upload to /srv/uploads/tmp: %w", &http.MaxBytesError{Limit: 10})
+	})
+	handler := api.GetHandler()
+
+	rec := doRequest(handler, "GET", "/internal", "")
+	body := decodeErrorBody(t, rec)
+	if rec.Code != http.StatusInternalServerError || body.Error.Message != "Internal error" {
+		t.Errorf("Unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+	requestID := rec.Header().Get("X-Request-Id")
+	if requestID == "" || !strings.Contains(rec.Body.String(), requestID) {
+		t.Errorf("Expected request ID in body %s", rec.Body.String())
+	}
+
+	rec = doRequest(handler, "GET", "/public", "")
+	body = decodeErrorBody(t, rec)
+	if rec.Code != http.StatusInternalServerError || body.Error.Message != "Try again later" {
+		t.Errorf("Unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = doRequest(handler, "GET", "/bad", "")
+	body = decodeErrorBody(t, rec)
+	if rec.Code != http.StatusBadRequest || body.Error.Message != "Bad request: missing name" {
+		t.Errorf("Unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = doRequest(handler, "GET", "/wrapped", "")
+	body = decodeErrorBody(t, rec)
+	if rec.Code != http.StatusInternalServerError || body.Error.Message != "Internal error" {
+		t.Errorf("Unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Only the generic message is sent for canceled calls and oversized bodies
+	rec = doRequest(handler, "GET", "/canceled", "")
+	body = decodeErrorBody(t, rec)
+	if rec.Code != 499 || body.Error.Message != "Client closed request" {
+		t.Errorf("Unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+	rec = doRequest(handler, "GET", "/large", "")
+	body = decodeErrorBody(t, rec)
+	if rec.Code != http.StatusRequestEntityTooLarge || body.Error.Message != "Request body too large" {
+		t.Errorf("Unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+
+	req := httptest.NewRequest("GET", "/internal", nil)
+	req.Header.Set("X-Request-Id", "client-id-1")
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Header().Get("X-Request-Id") != "client-id-1" || !strings.Contains(rec.Body.String(), "client-id-1") {
+		t.Errorf("Expected client request ID, got %s", rec.Body.String())
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	api := &dispatch.API{}
+	api.AddEndpoint("GET/users/{id}", func() {})
+	api.AddEndpoint("PUT/users/{id}", func() {})
+	api.AddEndpoint("OPTIONS/docs", func() string { return "docs" })
+	handler := api.GetHandler()
+
+	_, err := api.Call("POST", "/users/1", nil, nil)
+	if !errors.Is(err, dispatch.ErrorMethodNotAllowed) {
+		t.Errorf("Expected method not allowed, got %v", err)
+	}
+
+	rec := doRequest(handler, "POST", "/users/1", "")
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, HEAD, PUT, OPTIONS" {
+		t.Errorf("Unexpected response %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+	body := decodeErrorBody(t, rec)
+	if body.Error.Code != "method_not_allowed" {
+		t.Errorf("Unexpected error body %s", rec.Body.String())
+	}
+
+	rec = doRequest(handler, "POST", "/posts/1", "")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", rec.Code)
+	}
+
+	rec = doRequest(handler, "OPTIONS", "/users/1", "")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Allow") != "GET, HEAD, PUT, OPTIONS" {
+		t.Errorf("Unexpected response %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+
+	// Explicit OPTIONS endpoints are called for plain OPTIONS requests
+	rec = doRequest(handler, "OPTIONS", "/docs", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != `"docs"` {
+		t.Errorf("Unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHead(t *testing.T) {
+	api := &dispatch.API{}
+	api.AddEndpoint("GET/users/{id}", func(ctx *dispatch.Context) string { return ctx.PathVars["id"] })
+	api.AddEndpoint("GET/custom", func() string { return "get" })
+	api.AddEndpoint("HEAD/custom", func(ctx *dispatch.Context) { ctx.Writer.Header().Set("X-Custom", "head") })
+	handler := api.GetHandler()
+
+	get := doRequest(handler, "GET", "/users/12345", "")
+	head := doRequest(handler, "HEAD", "/users/12345", "")
+	if head.Code != http.StatusOK || head.Body.Len() != 0 {
+		t.Errorf("Unexpected response %d %q", head.Code, head.Body.String())
+	}
+	for _, header := range []string{"Content-Type", "Content-Length"} {
+		if head.Header().Get(header) != get.Header().Get(header) || head.Header().Get(header) == "" {
+			t.Errorf("Expected %s %q, got %q", header, get.Header().Get(header), head.Header().Get(header))
+		}
+	}
+
+	head = doRequest(handler, "HEAD", "/custom", "")
+	if head.Header().Get("X-Custom") != "head" {
+		t.Error("Expected HEAD endpoint to be called")
+	}
+
+	head = doRequest(handler, "HEAD", "/none", "")
+	if head.Code != http.StatusNotFound || head.Body.Len() != 0 {
+		t.Errorf("Unexpected response %d %q", head.Code, head.Body.String())
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	api := &dispatch.API{MaxBodySize: 16}
+	api.AddEndpoint("POST/echo", func(s string) string { return s })
+	api.AddEndpoint("POST/large", func(s string) string { return s }).MaxBodySize = 64
+	api.AddEndpoint("POST/stream", func(body io.Reader) (int, error) {
+		n, err := io.Copy(io.Discard, body)
+		return int(n), err
+	})
+	api.AddEndpoint("POST/request", func(r *http.Request) (string, error) {
+		b, err := io.ReadAll(r.Body)
+		return r.Method + " " + string(b), err
+	})
+
+	rec := doRequest(api.ServeHTTP, "POST", "/echo", `"short"`)
+	if rec.Code != http.StatusOK || rec.Body.String() != `"short"` {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	body := `"` + strings.Repeat("a", 32) + `"`
+	rec = doRequest(api.ServeHTTP, "POST", "/echo", body)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d %q", rec.Code, rec.Body.String())
+	}
+	if body := decodeErrorBody(t, rec); body.Error.Code != "payload_too_large" {
+		t.Errorf("Unexpected error code %q", body.Error.Code)
+	}
+	rec = doRequest(api.ServeHTTP, "POST", "/large", body)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	// Streamed bodies are limited as they are read
+	rec = doRequest(api.ServeHTTP, "POST", "/stream", "0123456789")
+	if rec.Code != http.StatusOK || rec.Body.String() != "10" {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	rec = doRequest(api.ServeHTTP, "POST", "/stream", body)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413, got %d %q", rec.Code, rec.Body.String())
+	}
+	rec = doRequest(api.ServeHTTP, "POST", "/request", "raw")
+	if rec.Code != http.StatusOK || rec.Body.String() != `"POST raw"` {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	// Inputs passed to Call are used for readers
+	out, err := api.Call("POST", "/stream", nil, []byte("abc"))
+	if err != nil || out != 3 {
+		t.Errorf("Unexpected result %v, %v", out, err)
+	}
+}
+
+func TestServeHTTPRewrite(t *testing.T) {
+	api := &dispatch.API{
+		PreRequestHooks: []dispatch.MiddlewareHook{
+			func(in *dispatch.EndpointInput) (*dispatch.EndpointInput, error) {
+				in.Path = strings.Replace(in.Path, "/old/", "/new/", 1)
+				return in, nil
+			},
+		},
+	}
+	api.AddEndpoint("GET/old/{id}", func(ctx *dispatch.Context) string { return "old " + ctx.PathVars["id"] })
+	api.AddEndpoint("GET/new/{id}", func(ctx *dispatch.Context) string { return "new " + ctx.PathVars["id"] })
+
+	// The request is matched again after the hook changes its path
+	rec := doRequest(api.ServeHTTP, "GET", "/old/1", "")
+	if rec.Body.String() != `"new 1"` {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	rec = doRequest(api.ServeHTTP, "GET", "/new/2", "")
+	if rec.Body.String() != `"new 2"` {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -2,15 +2,21 @@ package dispatch
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"time"
 )
 
 // An Endpoint represents an API procedure.
 type Endpoint struct {
 	pathMatcher *APIPath
+	handler     *handlerInfo
+	// chain is the endpoint's middleware, hooks and timeout wrapped around
+	// callHandler.
+	chain handlerChain
 
 	// Path is the API path string that will be exposed as an API endpoint. Must
-	// be unique.
+	// be unique; see API.Validate.
 	//
 	// The format of Path is METHOD/path/{pathvar}. Any path variables in curly
 	// brace notation will be parsed during API.Call and passed to Handler as
@@ -23,13 +29,73 @@ type Endpoint struct {
 	// (output, error).
 	//
 	// The input value for Handler, if not Context, will automatically be
-	// unmarshalled from the input to API.Call.
+	// unmarshalled from the input to API.Call. If it is a struct, fields tagged
+	// with path, query or header, such as `query:"limit"`, are then set from
+	// the path variables, query string or headers of the request. Fields
+	// tagged with `required:"true"` must not be left with their zero value, and
+	// any error decoding the input results in a 400 response.
+	//
+	// An input of type io.Reader or *http.Request instead receives the request
+	// body or the request itself, and an input of type *multipart.Form or
+	// *multipart.Reader receives the parts of a multipart/form-data body. The
+	// body is then not read before the handler is called, so the handler can
+	// stream it. The temporary files of a *multipart.Form are removed when the
+	// handler returns.
+	//
+	// An output of type File or []byte, or one that implements io.Reader, is
+	// sent as the raw response body instead of being encoded.
+	//
+	// An output that is a channel, or an iterator function of the form
+	// func(yield func(T) bool) or func(yield func(T, error) bool), is streamed
+	// to the client as each value is received, instead of being encoded as a
+	// whole. See API.GetHandler.
+	//
+	// A handler that takes a receive-only or send-only channel, such as
+	// func(*Context, <-chan In, chan<- Out) error, is a WebSocket handler.
+	// Requests are upgraded to WebSocket connections after the hooks have run,
+	// and the handler receives each incoming message, decoded from JSON like
+	// other inputs, on the first channel, and sends outgoing messages on the
+	// second. The incoming channel is closed, and the Context canceled, when
+	// the client disconnects. The connection is closed when the handler
+	// returns, with an error code if it returns an error.
 	Handler interface{}
 
 	// PreRequestHook is a middleware hook that runs before the handler. If the
 	// hook returns an error, that error will be returned and the handler will
 	// not be called.
 	PreRequestHooks []MiddlewareHook
+
+	// PostResponseHooks run after the handler, or after a PreRequestHook
+	// returns an error, in order. Each hook receives the output and error of
+	// the previous step, and returns the output and error to use instead.
+	PostResponseHooks []PostResponseHook
+
+	// Middleware wraps the hooks and handler of this endpoint. The first
+	// middleware is the outermost.
+	//
+	// Like those of the API, the middleware and hook lists of an endpoint are
+	// built into a single Handler when it is added. They can be replaced or
+	// appended to later, which rebuilds it, but elements set in place, such as
+	// PreRequestHooks[0] = hook, are ignored.
+	Middleware []Middleware
+
+	// Timeout, if positive, limits how long the middleware, hooks and handler
+	// of this endpoint may run. When it expires, the Context is canceled, and
+	// the call returns ErrorTimeout without waiting for the handler. It
+	// doesn't apply to handlers whose output is streamed, or to WebSocket
+	// handlers, which run until the stream ends or the client disconnects.
+	Timeout time.Duration
+
+	// MaxBodySize overrides API.MaxBodySize for this endpoint if non-zero. A
+	// negative value removes the limit.
+	MaxBodySize int64
+
+	// DecodeOptions overrides API.DecodeOptions for this endpoint if set.
+	DecodeOptions *DecodeOptions
+
+	// DisableCompression prevents the responses of this endpoint from being
+	// compressed, such as when its outputs are already compressed.
+	DisableCompression bool
 }
 
 // EndpointInput represents the input to an endpoint call. These inputs can be
@@ -51,9 +117,84 @@ type EndpointInput struct {
 // to return early if a call isn't authorized.
 type MiddlewareHook func(*EndpointInput) (*EndpointInput, error)
 
+// PostResponseHook is a function type that is called with the result of each
+// request.
+//
+// These hooks are called after the endpoint handler, with the input that was
+// passed to it and the output and error that it returned. They can return the
+// output and error unchanged, or transform them, for example to wrap outputs in
+// a response envelope. Hooks are called even when the handler or an earlier
+// hook returned an error, which makes them useful for auditing and logging.
+type PostResponseHook func(in *EndpointInput, out interface{}, err error) (interface{}, error)
+
+// handlerChain returns the endpoint's handler wrapped with its middleware,
+// hooks and timeout. It is built when the endpoint is added, and again only if
+// the timeout changes, or one of the lists is replaced or appended to.
+func (endpoint *Endpoint) handlerChain() Handler {
+	timeout := endpoint.Timeout
+	if endpoint.handler.stream || endpoint.handler.webSocket {
+		// Streams are sent after the handler returns, and connections last
+		// until the client disconnects, so neither must be canceled
+		timeout = 0
+	}
+	return endpoint.chain.get(endpoint.callHandler, endpoint.Middleware, endpoint.PreRequestHooks, endpoint.PostResponseHooks, timeout)
+}
+
+// callHandler calls the endpoint's handler. Panics in the handler are recovered
+// and returned as ErrorInternal, so that PostResponseHooks still see the
+// result.
+func (endpoint *Endpoint) callHandler(in *EndpointInput) (out interface{}, err error) {
+	defer recoverInternal(&out, &err)
+	in.Ctx.noOutput = endpoint.handler.noOutput
+	return endpoint.handler.invoke(in.Ctx, in.Input)
+}
+
 // AddEndpoint registers an endpoint with this API. It also allows adding
-// middleware hooks to the endpoint.
-func (api *API) AddEndpoint(path string, handler interface{}, hooks ...MiddlewareHook) {
+// middleware hooks to the endpoint. The new endpoint is returned, so that its
+// other options, such as PostResponseHooks, can be set.
+//
+// The path and the handler's signature are checked immediately, and an invalid
+// path or handler is a fatal error.
+func (api *API) AddEndpoint(path string, handler interface{}, hooks ...MiddlewareHook) *Endpoint {
+	endpoint, err := addEndpoint(api, path, handler, hooks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return endpoint
+}
+
+// Handle registers an endpoint with an API or Group, like AddEndpoint, but with
+// a handler whose input and output types are checked at compile time. The
+// input is decoded the same way as for AddEndpoint, and the handler is called
+// without reflection. For example:
+//
+//	dispatch.Handle(api, "POST/users", func(ctx *dispatch.Context, in NewUser) (*User, error) {
+//		...
+//	})
+func Handle[In, Out any](routes Routes, path string, handler func(*Context, In) (Out, error), hooks ...MiddlewareHook) *Endpoint {
+	info, err := newTypedHandlerInfo(handler)
+	if err != nil {
+		log.Fatalf("Invalid handler for %s: %v", path, err)
+	}
+	endpoint, err := routes.insertEndpoint(path, handler, info, hooks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return endpoint
+}
+
+// addEndpoint creates an endpoint and adds it to routes, or returns an error if
+// the path or handler is invalid.
+func addEndpoint(routes Routes, path string, handler interface{}, hooks []MiddlewareHook) (*Endpoint, error) {
+	info, err := newHandlerInfo(handler)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid handler for %s: %v", path, err)
+	}
+	return routes.insertEndpoint(path, handler, info, hooks)
+}
+
+// insertEndpoint adds an endpoint for an already analyzed handler to the API.
+func (api *API) insertEndpoint(path string, handler interface{}, info *handlerInfo, hooks []MiddlewareHook) (*Endpoint, error) {
 	if api.Endpoints == nil {
 		api.Endpoints = make([]*Endpoint, 0)
 	}
@@ -61,6 +202,7 @@ func (api *API) AddEndpoint(path string, handler interface{}, hooks ...Middlewar
 	endpoint := Endpoint{
 		Path:    path,
 		Handler: handler,
+		handler: info,
 	}
 	// Configure middleware hooks
 	if len(hooks) >= 1 {
@@ -70,7 +212,33 @@ func (api *API) AddEndpoint(path string, handler interface{}, hooks ...Middlewar
 	var err error
 	endpoint.pathMatcher, err = NewAPIPath(path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	endpoint.handlerChain()
 	api.Endpoints = append(api.Endpoints, &endpoint)
+	if conflict := api.router.insert(&endpoint); conflict != nil {
+		log.Printf("Warning: %v\n", conflict)
+	}
+	return &endpoint, nil
+}
+
+// Validate checks that every registered endpoint can be matched. It returns a
+// RouteConflicts error listing each exact duplicate, and each pair of paths
+// which differ only in the names of their path variables.
+//
+// Endpoints that merely overlap are not conflicts. When more than one endpoint
+// matches a request, the endpoint whose path has a literal element at the
+// first position where they differ is chosen over the one with a path
+// variable there, and a path variable is chosen over a catch-all variable, so
+// the result never depends on registration order. Among path variables, one
+// with a named constraint such as {id:int} is chosen over one with a regular
+// expression such as {slug:[a-z0-9]+}, which is chosen over an unconstrained
+// one, and variables with different constraints of the same kind are tried in
+// the lexical order of their constraints. When two endpoints do conflict, the
+// one registered first is matched.
+func (api *API) Validate() error {
+	if len(api.router.conflicts) == 0 {
+		return nil
+	}
+	return append(RouteConflicts(nil), api.router.conflicts...)
 }
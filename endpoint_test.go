@@ -2,7 +2,9 @@ package dispatch
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"net/http/httptest"
 	"strings"
 	"testing"
 )
@@ -44,12 +46,33 @@ func TestEndpointWithContext(t *testing.T) {
 
 func TestEndpointBadHandler(t *testing.T) {
 	api := API{}
-	api.AddEndpoint("GET/test", testBadHandler)
-
-	_, err := api.Call("GET", "/test", nil, []byte("{\"foo\": \"TestAdmin\"}"))
+	_, err := addEndpoint(&api, "GET/test", testBadHandler, nil)
 	if err == nil {
 		t.Error("Should have failed!")
 	}
+
+	badHandlers := []interface{}{
+		"not a function",
+		func(in1 testInputType, ctx *Context, in2 int) {},
+		func(ctx1 *Context, ctx2 Context) {},
+		func() (error, string) { return nil, "" },
+		func() (string, string, error) { return "", "", nil },
+		func(in struct {
+			Ch chan int `query:"ch"`
+		}) {
+		},
+	}
+	for _, handler := range badHandlers {
+		if _, err := addEndpoint(&api, "GET/test", handler, nil); err == nil {
+			t.Errorf("%T should have been rejected", handler)
+		}
+	}
+
+	// Rejected endpoints are not registered
+	_, err = api.Call("GET", "/test", nil, []byte("{}"))
+	if err != ErrorNotFound {
+		t.Errorf("Expected not found, got %v", err)
+	}
 }
 
 func TestMiddleware(t *testing.T) {
@@ -95,3 +118,129 @@ func middlewareHook(input *EndpointInput) (*EndpointInput, error) {
 	}
 	return input, nil
 }
+
+type testBoundInput struct {
+	ID        int      `path:"id"`
+	Limit     *int     `query:"limit"`
+	Tags      []string `query:"tag"`
+	RequestID string   `header:"X-Request-Id"`
+	Name      string   `json:"name"`
+}
+
+func TestInputBinding(t *testing.T) {
+	api := API{}
+	api.AddEndpoint("POST/users/{id}", func(in testBoundInput) testBoundInput {
+		return in
+	})
+
+	req := httptest.NewRequest("POST", "/users/42?limit=10&tag=a&tag=b", nil)
+	req.Header.Set("X-Request-Id", "abc")
+	out, err := api.Call("POST", "/users/42", &Context{Request: req}, []byte(`{"name": "bob"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := out.(testBoundInput)
+	if in.ID != 42 || in.Limit == nil || *in.Limit != 10 || in.RequestID != "abc" || in.Name != "bob" {
+		t.Errorf("Incorrect bound input %+v", in)
+	}
+	if len(in.Tags) != 2 || in.Tags[1] != "b" {
+		t.Errorf("Incorrect tags %v", in.Tags)
+	}
+
+	// A body is not required when the input is bound from the request
+	out, err = api.Call("POST", "/users/7", &Context{Request: req}, nil)
+	if err != nil || out.(testBoundInput).ID != 7 {
+		t.Errorf("Incorrect bound input %+v (%v)", out, err)
+	}
+
+	req = httptest.NewRequest("POST", "/users/42?limit=ten", nil)
+	_, err = api.Call("POST", "/users/42", &Context{Request: req}, []byte("{}"))
+	if !errors.Is(err, ErrorBadRequest) || !strings.Contains(err.Error(), "limit") {
+		t.Errorf("Expected bad request, got %v", err)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	api := API{}
+	Handle(&api, "POST/users/{id}", func(ctx *Context, in testBoundInput) (*testBoundInput, error) {
+		if in.Name == "" {
+			return nil, ErrorBadRequest
+		}
+		return &in, nil
+	})
+
+	out, err := api.Call("POST", "/users/42", nil, []byte(`{"name": "bob"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := out.(*testBoundInput)
+	if in.ID != 42 || in.Name != "bob" {
+		t.Errorf("Incorrect input %+v", in)
+	}
+
+	_, err = api.Call("POST", "/users/42", nil, []byte(`{}`))
+	if err != ErrorBadRequest {
+		t.Errorf("Expected bad request, got %v", err)
+	}
+
+	_, err = api.Call("POST", "/users/42", nil, []byte(`{"name": 1}`))
+	if err == nil {
+		t.Error("Expected decoding error")
+	}
+}
+
+func TestGlobalHooks(t *testing.T) {
+	var audit []string
+	api := API{
+		PreRequestHooks: []MiddlewareHook{
+			func(in *EndpointInput) (*EndpointInput, error) {
+				// Rewrite legacy paths before matching
+				in.Path = strings.Replace(in.Path, "/old/", "/new/", 1)
+				return in, nil
+			},
+		},
+		PostResponseHooks: []PostResponseHook{
+			func(in *EndpointInput, out interface{}, err error) (interface{}, error) {
+				audit = append(audit, fmt.Sprintf("%s %s %v", in.Method, in.Path, err))
+				if err != nil {
+					return nil, err
+				}
+				return map[string]interface{}{"data": out}, nil
+			},
+		},
+	}
+	endpoint := api.AddEndpoint("GET/new/{id}", func(ctx *Context) string {
+		if ctx.PathVars["id"] == "panic" {
+			panic("handler panic")
+		}
+		return ctx.PathVars["id"]
+	})
+	endpoint.PostResponseHooks = []PostResponseHook{
+		func(in *EndpointInput, out interface{}, err error) (interface{}, error) {
+			if err == ErrorInternal {
+				return nil, ErrorConflict
+			}
+			return strings.ToUpper(out.(string)), nil
+		},
+	}
+
+	out, err := api.Call("GET", "/old/abc", nil, nil)
+	if err != nil || fmt.Sprint(out) != "map[data:ABC]" {
+		t.Errorf("Unexpected result %v (%v)", out, err)
+	}
+
+	_, err = api.Call("GET", "/old/panic", nil, nil)
+	if err != ErrorConflict {
+		t.Errorf("Expected conflict, got %v", err)
+	}
+
+	_, err = api.Call("GET", "/none", nil, nil)
+	if err != ErrorNotFound {
+		t.Errorf("Expected not found, got %v", err)
+	}
+
+	expected := []string{"GET /new/abc <nil>", "GET /new/panic Conflict", "GET /none Path not found"}
+	if fmt.Sprint(audit) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected audit log %v", audit)
+	}
+}
@@ -0,0 +1,164 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// HTTPError is an error that carries an HTTP status code, and is rendered by
+// the handler from GetHandler as a JSON error body. Handlers and middleware
+// hooks can return an HTTPError, or wrap one with fmt.Errorf and %w, to control
+// the response status. Any other error results in status 500.
+type HTTPError struct {
+	// Status is the HTTP status code of the response.
+	Status int
+	// Code is a short machine-readable error code, such as "not_found".
+	Code string
+	// Message is a human-readable description of the error.
+	Message string
+	// Details is optional additional data about the error, which is marshalled
+	// into the error body.
+	Details interface{}
+	// Header holds optional headers to set on the error response, such as
+	// Allow or Retry-After.
+	Header http.Header
+}
+
+// NewHTTPError creates an HTTPError with the given status, code and message.
+func NewHTTPError(status int, code, message string) *HTTPError {
+	return &HTTPError{Status: status, Code: code, Message: message}
+}
+
+func (e *HTTPError) Error() string {
+	return e.Message
+}
+
+// WithDetails returns a copy of the error with Details set. The copy still
+// matches the original error with errors.Is.
+func (e *HTTPError) WithDetails(details interface{}) *HTTPError {
+	copied := *e
+	copied.Details = details
+	return &copied
+}
+
+// Is reports whether target is an HTTPError with the same status and code, so
+// that errors.Is matches copies made with WithDetails.
+func (e *HTTPError) Is(target error) bool {
+	t, ok := target.(*HTTPError)
+	return ok && t.Status == e.Status && t.Code == e.Code
+}
+
+// errorBody is the JSON envelope that errors are rendered as:
+//
+//	{"error": {"code": "not_found", "message": "Path not found"}}
+type errorBody struct {
+	Error errorBodyContent `json:"error"`
+}
+
+type errorBodyContent struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+// publicError marks an error as safe to show to API clients.
+type publicError struct {
+	err error
+}
+
+func (e *publicError) Error() string { return e.err.Error() }
+func (e *publicError) Unwrap() error { return e.err }
+
+// Public marks err as safe to show to API clients, so its message is sent
+// verbatim even if API.HideInternalErrors is set. HTTPErrors with a status
+// below 500 are always considered public, and don't need to be marked.
+func Public(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &publicError{err}
+}
+
+// toHTTPError finds the HTTPError in err's chain, and returns it with its
+// message replaced by the message of err, which includes any context added by
+// wrapping. Canceled calls and bodies over the size limit are given the status
+// of errClientClosedRequest and ErrorPayloadTooLarge, and any other error is
+// an internal server error. If hide is set, the message of a server error, a
+// canceled call or an oversized body is replaced with the HTTPError's own
+// message, or a generic one if there is none, unless err was marked with
+// Public.
+func toHTTPError(err error, hide bool) *HTTPError {
+	var httpErr *HTTPError
+	var maxBytesErr *http.MaxBytesError
+	var public *publicError
+	var copied HTTPError
+	switch {
+	case errors.As(err, &httpErr):
+		copied = *httpErr
+	case errors.Is(err, context.Canceled):
+		copied = *errClientClosedRequest
+	case errors.As(err, &maxBytesErr):
+		copied = *ErrorPayloadTooLarge.(*HTTPError)
+	default:
+		copied = *ErrorInternal.(*HTTPError)
+	}
+	// The context wrapped around server errors can hold internal details, and
+	// so can the errors that canceled calls and oversized bodies are wrapped in
+	// by the code that was reading them
+	if !hide || httpErr != nil && copied.Status < 500 || errors.As(err, &public) {
+		copied.Message = err.Error()
+	}
+	return &copied
+}
+
+// ErrorBadRequest represents an error from a malformed request.
+var ErrorBadRequest error = NewHTTPError(http.StatusBadRequest, "bad_request", "Bad request")
+
+// ErrorNotFound represents a 404 error.
+var ErrorNotFound error = NewHTTPError(http.StatusNotFound, "not_found", "Path not found")
+
+// ErrorMethodNotAllowed represents a request to a path that has endpoints, but
+// none for the request's method. The errors returned by API.Call have an Allow
+// header listing the methods that are registered for the path.
+var ErrorMethodNotAllowed error = NewHTTPError(http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+
+// ErrorUnauthorized represents a request without valid credentials.
+var ErrorUnauthorized error = NewHTTPError(http.StatusUnauthorized, "unauthorized", "Unauthorized")
+
+// ErrorForbidden represents a request that is not allowed for the caller.
+var ErrorForbidden error = NewHTTPError(http.StatusForbidden, "forbidden", "Forbidden")
+
+// ErrorConflict represents a request that conflicts with the current state of
+// a resource.
+var ErrorConflict error = NewHTTPError(http.StatusConflict, "conflict", "Conflict")
+
+// ErrorTimeout represents a call that did not finish before its endpoint's
+// Timeout.
+var ErrorTimeout error = NewHTTPError(http.StatusServiceUnavailable, "timeout", "Request timed out")
+
+// ErrorPayloadTooLarge represents a request with a body larger than the
+// endpoint's maximum body size. Errors from reading a body limited by
+// http.MaxBytesReader are also rendered with this status.
+var ErrorPayloadTooLarge error = NewHTTPError(http.StatusRequestEntityTooLarge, "payload_too_large", "Request body too large")
+
+// ErrorUnsupportedMediaType represents a request body whose Content-Type has
+// no codec in API.Codecs.
+var ErrorUnsupportedMediaType error = NewHTTPError(http.StatusUnsupportedMediaType, "unsupported_media_type", "Unsupported media type")
+
+// ErrorNotAcceptable represents a request whose Accept header allows none of
+// the media types in API.Codecs.
+var ErrorNotAcceptable error = NewHTTPError(http.StatusNotAcceptable, "not_acceptable", "Not acceptable")
+
+// ErrorPreconditionFailed represents a request whose If-Match header matches
+// no current ETag of the resource, such as an update based on an outdated copy.
+var ErrorPreconditionFailed error = NewHTTPError(http.StatusPreconditionFailed, "precondition_failed", "Precondition failed")
+
+// errClientClosedRequest represents a call that was canceled, usually because
+// the client disconnected. Its status is the one used by nginx, since net/http
+// has none.
+var errClientClosedRequest = NewHTTPError(499, "client_closed_request", "Client closed request")
+
+// ErrorInternal represents some unexpected internal error.
+var ErrorInternal error = NewHTTPError(http.StatusInternalServerError, "internal", "Internal error")
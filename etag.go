@@ -0,0 +1,118 @@
+package dispatch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// ETag returns a strong ETag for a response body, the one API.ETags adds to
+// responses with data as their body.
+func ETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagList splits the value of an If-Match or If-None-Match header into its
+// entity tags, including any W/ prefix, or "*". Parsing stops at the first
+// malformed tag.
+func etagList(header string) []string {
+	var tags []string
+	for {
+		header = strings.TrimLeft(header, " \t,")
+		if header == "" {
+			return tags
+		}
+		if header[0] == '*' {
+			tags = append(tags, "*")
+			header = header[1:]
+			continue
+		}
+		start := 0
+		if strings.HasPrefix(header, "W/") {
+			start = 2
+		}
+		if len(header) <= start || header[start] != '"' {
+			return tags
+		}
+		end := strings.IndexByte(header[start+1:], '"')
+		if end < 0 {
+			return tags
+		}
+		end += start + 2
+		tags = append(tags, header[:end])
+		header = header[end:]
+	}
+}
+
+// etagMatches reports whether the value of an If-Match or If-None-Match header
+// matches etag, which is empty if the resource doesn't exist. Tags are
+// compared without their W/ prefix, since the only weak tags sent by the API
+// are strong ones weakened by compression, which still identify the same
+// content.
+func etagMatches(header, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range etagList(header) {
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified reports whether a GET or HEAD request can be answered with 304
+// Not Modified, given the ETag and Last-Modified headers of its response.
+// If-Modified-Since is ignored if the request has an If-None-Match header.
+func notModified(r *http.Request, header http.Header) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, header.Get("ETag"))
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// writeNotModified writes a 304 response. Headers that describe the body are
+// removed, and validators such as ETag are kept.
+func writeNotModified(w http.ResponseWriter) {
+	header := w.Header()
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// CheckIfMatch returns ErrorPreconditionFailed if the request has an If-Match
+// header that doesn't match etag, the current ETag of the resource it
+// modifies. An empty etag means the resource doesn't exist, which only
+// requests without If-Match are allowed to modify. Handlers for PUT and
+// DELETE requests can call it before making changes, so that clients can't
+// overwrite changes they haven't seen:
+//
+//	_, etag, err := store.Get(ctx, id)
+//	if err != nil {
+//		return nil, err
+//	}
+//	if err := ctx.CheckIfMatch(etag); err != nil {
+//		return nil, err
+//	}
+func (c *Context) CheckIfMatch(etag string) error {
+	if c.Request == nil {
+		return nil
+	}
+	ifMatch := c.Request.Header.Get("If-Match")
+	if ifMatch == "" || etagMatches(ifMatch, etag) {
+		return nil
+	}
+	return ErrorPreconditionFailed
+}
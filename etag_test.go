@@ -0,0 +1,116 @@
+package dispatch_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/olafal0/dispatch"
+)
+
+type versionedItem struct {
+	dispatch.Response
+	Name string `json:"name"`
+}
+
+func TestETags(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	api := &dispatch.API{ETags: true}
+	api.AddEndpoint("GET/items", func() []string { return []string{"a", "b"} })
+	api.AddEndpoint("GET/item", func() versionedItem {
+		out := versionedItem{Name: "a"}
+		out.SetETag("v1")
+		out.SetLastModified(modified)
+		return out
+	})
+
+	get := func(method, path string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("GET", "/items", nil)
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || len(etag) != 34 {
+		t.Fatalf("Unexpected response %d with ETag %q", rec.Code, etag)
+	}
+	if again := get("GET", "/items", nil).Header().Get("ETag"); again != etag {
+		t.Errorf("ETag changed from %s to %s", etag, again)
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		header       map[string]string
+		status       int
+	}{
+		{"GET", "/items", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"HEAD", "/items", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"GET", "/items", map[string]string{"If-None-Match": `"other", W/` + etag}, http.StatusNotModified},
+		{"GET", "/items", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"GET", "/items", map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{"GET", "/item", map[string]string{"If-None-Match": `"v1"`}, http.StatusNotModified},
+		{"GET", "/item", map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)}, http.StatusNotModified},
+		{"GET", "/item", map[string]string{"If-Modified-Since": modified.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK},
+		// If-Modified-Since is ignored when If-None-Match is sent
+		{"GET", "/item", map[string]string{"If-None-Match": `"v0"`, "If-Modified-Since": modified.Format(http.TimeFormat)}, http.StatusOK},
+	} {
+		rec := get(tc.method, tc.path, tc.header)
+		if rec.Code != tc.status {
+			t.Errorf("%s %s with %v: expected %d, got %d", tc.method, tc.path, tc.header, tc.status, rec.Code)
+		}
+		if rec.Code == http.StatusNotModified && (rec.Body.Len() != 0 || rec.Header().Get("ETag") == "" || rec.Header().Get("Content-Type") != "") {
+			t.Errorf("%s %s: unexpected 304 response %v %q", tc.method, tc.path, rec.Header(), rec.Body.String())
+		}
+	}
+
+	if etag := get("GET", "/item", nil).Header().Get("ETag"); etag != `"v1"` {
+		t.Errorf("Handler ETag was replaced with %s", etag)
+	}
+}
+
+func TestCheckIfMatch(t *testing.T) {
+	version := 1
+	currentETag := func() string { return `"v` + strconv.Itoa(version) + `"` }
+	api := &dispatch.API{}
+	api.AddEndpoint("PUT/item", func(ctx *dispatch.Context) (*dispatch.Response, error) {
+		if err := ctx.CheckIfMatch(currentETag()); err != nil {
+			return nil, err
+		}
+		version++
+		out := &dispatch.Response{}
+		out.SetETag(currentETag())
+		return out, nil
+	})
+
+	put := func(ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/item", nil)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := put(`"v1"`)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("ETag") != `"v2"` {
+		t.Fatalf("Unexpected response %d %v", rec.Code, rec.Header())
+	}
+	rec = put(`"v1"`)
+	if rec.Code != http.StatusPreconditionFailed || decodeErrorBody(t, rec).Error.Code != "precondition_failed" {
+		t.Errorf("Expected 412, got %d %q", rec.Code, rec.Body.String())
+	}
+	// Tags weakened by compression still match
+	for _, ifMatch := range []string{`W/"v2"`, `"v0", "v3"`, "*", ""} {
+		if rec := put(ifMatch); rec.Code != http.StatusNoContent {
+			t.Errorf("If-Match %q: expected 204, got %d", ifMatch, rec.Code)
+		}
+	}
+}
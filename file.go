@@ -0,0 +1,183 @@
+package dispatch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"reflect"
+	"time"
+)
+
+// multipartMaxMemory is the number of bytes of a multipart form that are kept
+// in memory, as for http.Request.FormFile. Larger files are stored in
+// temporary files.
+const multipartMaxMemory = 32 << 20
+
+var (
+	multipartFormType   = reflect.TypeOf(&multipart.Form{})
+	multipartReaderType = reflect.TypeOf(&multipart.Reader{})
+	fileType            = reflect.TypeOf(File{})
+	filePtrType         = reflect.TypeOf(&File{})
+	bytesType           = reflect.TypeOf([]byte(nil))
+)
+
+// File is a handler output that is sent as the raw response body, instead of
+// being encoded. Outputs that implement io.Reader, and []byte outputs, are
+// sent the same way, as a File with only Content set, so their Content-Type is
+// application/octet-stream. To choose it, return a File instead:
+//
+//	return &dispatch.File{Content: bytes.NewReader(png), ContentType: "image/png"}, nil
+//
+// If Content implements io.Seeker, the response supports range requests and
+// conditional requests based on ModTime, using http.ServeContent. If Content
+// implements io.Closer, it is closed after the response is written.
+type File struct {
+	// Content is the body of the response.
+	Content io.Reader
+
+	// Name is the file name sent in the Content-Disposition header. If
+	// ContentType is empty, it is also used to choose the Content-Type.
+	Name string
+
+	// ContentType is the media type of the content. If empty, it is chosen by
+	// the extension of Name, or else application/octet-stream. The type is
+	// never detected from the content, so that content from users can't be
+	// served as HTML.
+	ContentType string
+
+	// Attachment asks browsers to download the file instead of displaying it.
+	Attachment bool
+
+	// ModTime is the time the content was last modified, if known.
+	ModTime time.Time
+}
+
+// isRawOutputType reports whether outputs of type t are sent as raw files.
+func isRawOutputType(t reflect.Type) bool {
+	return t == fileType || t == filePtrType || t == bytesType || t.Implements(readerType)
+}
+
+// rawOutput returns the File for an output that is sent as a raw body.
+func rawOutput(output interface{}) (*File, bool) {
+	if output == nil || isNilPointer(output) {
+		return nil, false
+	}
+	switch output := output.(type) {
+	case File:
+		return &output, true
+	case *File:
+		return output, true
+	case io.Reader:
+		return &File{Content: output}, true
+	case []byte:
+		return &File{Content: bytes.NewReader(output)}, true
+	}
+	return nil, false
+}
+
+// writeFile writes a File as the response body.
+func writeFile(w http.ResponseWriter, r *http.Request, f *File) {
+	if closer, ok := f.Content.(io.Closer); ok {
+		defer closer.Close()
+	}
+	header := w.Header()
+	header.Set("X-Content-Type-Options", "nosniff")
+	contentType := f.ContentType
+	if contentType == "" && f.Name != "" {
+		contentType = mime.TypeByExtension(path.Ext(f.Name))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header.Set("Content-Type", contentType)
+	if f.Name != "" || f.Attachment {
+		disposition := "inline"
+		if f.Attachment {
+			disposition = "attachment"
+		}
+		var params map[string]string
+		if f.Name != "" {
+			params = map[string]string{"filename": path.Base(f.Name)}
+		}
+		header.Set("Content-Disposition", mime.FormatMediaType(disposition, params))
+	}
+
+	if content, ok := f.Content.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", f.ModTime, content)
+		return
+	}
+	if !f.ModTime.IsZero() {
+		header.Set("Last-Modified", f.ModTime.UTC().Format(http.TimeFormat))
+		if notModified(r, header) {
+			writeNotModified(w)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead && f.Content != nil {
+		io.Copy(w, f.Content)
+	}
+}
+
+// multipartRequest returns the request to parse a multipart input from. If the
+// input was already read, it is used as the body of a copy of the request.
+func multipartRequest(ctx *Context, input []byte) (*http.Request, error) {
+	if ctx.Request == nil {
+		return nil, fmt.Errorf("%w: multipart input requires an HTTP request", ErrorUnsupportedMediaType)
+	}
+	if input == nil {
+		return ctx.Request, nil
+	}
+	r := ctx.Request.WithContext(ctx.Request.Context())
+	r.Body = io.NopCloser(bytes.NewReader(input))
+	r.Form, r.PostForm, r.MultipartForm = nil, nil, nil
+	return r, nil
+}
+
+// multipartInput returns the value for an input of type *multipart.Form or
+// *multipart.Reader. The temporary files of a form are removed by
+// removeFormFiles when the handler returns.
+func multipartInput(t reflect.Type, ctx *Context, input []byte) (reflect.Value, error) {
+	r, err := multipartRequest(ctx, input)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	if t == multipartReaderType {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			return reflect.Value{}, multipartError(err)
+		}
+		return reflect.ValueOf(reader), nil
+	}
+	if err := r.ParseMultipartForm(multipartMaxMemory); err != nil {
+		return reflect.Value{}, multipartError(err)
+	}
+	return reflect.ValueOf(r.MultipartForm), nil
+}
+
+// multipartError converts an error from parsing a multipart body to an
+// HTTPError.
+func multipartError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, http.ErrNotMultipart) || errors.Is(err, http.ErrMissingBoundary):
+		return fmt.Errorf("%w: %v", ErrorUnsupportedMediaType, err)
+	case errors.As(err, &maxBytesErr):
+		return err
+	}
+	return fmt.Errorf("%w: invalid multipart body: %v", ErrorBadRequest, err)
+}
+
+// removeFormFiles removes the temporary files of a *multipart.Form input after
+// the handler returns. net/http only removes the files of forms parsed from
+// the original request, and inputs may be parsed from a copy of it.
+func removeFormFiles(input interface{}) {
+	if form, ok := input.(*multipart.Form); ok && form != nil {
+		form.RemoveAll()
+	}
+}
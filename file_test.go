@@ -0,0 +1,151 @@
+package dispatch_test
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olafal0/dispatch"
+)
+
+func multipartBody(t *testing.T, files map[string]string) (*bytes.Buffer, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("title", "report")
+	for name, content := range files {
+		fw, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, content)
+	}
+	mw.Close()
+	return body, mw.FormDataContentType()
+}
+
+func TestUpload(t *testing.T) {
+	api := &dispatch.API{}
+	api.AddEndpoint("POST/files", func(form *multipart.Form) (string, error) {
+		f, err := form.File["file"][0].Open()
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		content, err := io.ReadAll(f)
+		return form.Value["title"][0] + ": " + form.File["file"][0].Filename + " " + string(content), err
+	})
+	api.AddEndpoint("POST/parts", func(reader *multipart.Reader) (names []string, err error) {
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return names, nil
+			} else if err != nil {
+				return nil, err
+			}
+			names = append(names, part.FormName())
+		}
+	})
+
+	body, contentType := multipartBody(t, map[string]string{"a.txt": "hello"})
+	req := httptest.NewRequest("POST", "/files", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != `"report: a.txt hello"` {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest("POST", "/parts", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", contentType)
+	rec = httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != `["title","file"]` {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = doRequest(api.ServeHTTP, "POST", "/files", `{"file":"a.txt"}`)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestUploadTempFiles(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	api := &dispatch.API{}
+	upload := api.AddEndpoint("POST/large", func(form *multipart.Form) (int, error) {
+		entries, err := os.ReadDir(tmp)
+		return len(entries), err
+	})
+	upload.MaxBodySize = -1
+	upload.Timeout = time.Minute
+
+	// Files larger than the in-memory limit are stored in temporary files
+	body, contentType := multipartBody(t, map[string]string{"large.bin": strings.Repeat("a", 33<<20)})
+	req := httptest.NewRequest("POST", "/large", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "1" {
+		t.Fatalf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Errorf("Temporary files were not removed: %v", entries)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	api := &dispatch.API{}
+	api.AddEndpoint("GET/files/{name}", func(ctx *dispatch.Context) *dispatch.File {
+		return &dispatch.File{
+			Content:    strings.NewReader("0123456789"),
+			Name:       ctx.PathVars["name"],
+			Attachment: true,
+			ModTime:    modTime,
+		}
+	})
+	api.AddEndpoint("GET/bytes", func() []byte { return []byte("<p>raw</p>") })
+	api.AddEndpoint("GET/stream", func() io.Reader {
+		return io.MultiReader(strings.NewReader("abc"), strings.NewReader("def"))
+	})
+
+	req := httptest.NewRequest("GET", "/files/report.txt", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	req.Header.Set("Accept", "text/plain")
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "234" {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	header := rec.Header()
+	if header.Get("Content-Disposition") != `attachment; filename=report.txt` || !strings.HasPrefix(header.Get("Content-Type"), "text/plain") {
+		t.Errorf("Unexpected headers %v", header)
+	}
+
+	req = httptest.NewRequest("GET", "/files/report.txt", nil)
+	req.Header.Set("If-Modified-Since", modTime.Format(http.TimeFormat))
+	rec = httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("Expected 304, got %d", rec.Code)
+	}
+
+	rec = doRequest(api.ServeHTTP, "GET", "/stream", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "abcdef" || rec.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("Unexpected response %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+
+	rec = doRequest(api.ServeHTTP, "GET", "/bytes", "")
+	// Raw content is never sniffed, so it can't be served as HTML
+	if rec.Code != http.StatusOK || rec.Body.String() != "<p>raw</p>" || rec.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("Unexpected response %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+}
@@ -1,9 +1,11 @@
 module github.com/olafal0/dispatch
 
-go 1.14
+go 1.21
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/gorilla/websocket v1.5.3
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
 	golang.org/x/crypto v0.0.0-20200317142112-1b76d66859c6
 )
@@ -0,0 +1,79 @@
+package dispatch
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Routes is implemented by API and Group, which endpoints can be added to.
+type Routes interface {
+	// AddEndpoint registers an endpoint, as described by API.AddEndpoint.
+	AddEndpoint(path string, handler interface{}, hooks ...MiddlewareHook) *Endpoint
+	// Group returns a Group whose endpoints share a path prefix and middleware
+	// hooks.
+	Group(prefix string, hooks ...MiddlewareHook) *Group
+	// Mount registers an http.Handler, as described by API.Mount.
+	Mount(path string, handler http.Handler, hooks ...MiddlewareHook) *Endpoint
+
+	insertEndpoint(path string, handler interface{}, info *handlerInfo, hooks []MiddlewareHook) (*Endpoint, error)
+}
+
+// A Group adds endpoints to an API under a shared path prefix, and with shared
+// middleware hooks. For example, these endpoints both use the AuthorizerHook,
+// and are matched at GET/v1/admin/users and DELETE/v1/admin/users/{id}:
+//
+//	admin := api.Group("/v1/admin", auth.AuthorizerHook(signer))
+//	admin.AddEndpoint("GET/users", listUsers)
+//	admin.AddEndpoint("DELETE/users/{id}", deleteUser)
+//
+// Groups can be nested. The prefix and hooks of the outer group come first.
+type Group struct {
+	parent Routes
+	prefix string
+	hooks  []MiddlewareHook
+}
+
+// Group returns a Group that adds endpoints to this API under prefix, with
+// hooks running before the hooks of each endpoint.
+func (api *API) Group(prefix string, hooks ...MiddlewareHook) *Group {
+	return newGroup(api, prefix, hooks)
+}
+
+// Group returns a nested group, whose prefix and hooks follow the prefix and
+// hooks of g.
+func (g *Group) Group(prefix string, hooks ...MiddlewareHook) *Group {
+	return newGroup(g, prefix, hooks)
+}
+
+func newGroup(parent Routes, prefix string, hooks []MiddlewareHook) *Group {
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix = "/" + prefix
+	}
+	return &Group{parent, prefix, hooks}
+}
+
+// AddEndpoint registers an endpoint with the group's API, with the group's
+// prefix inserted after the method of path. The path GET/ adds an endpoint for
+// the prefix itself.
+func (g *Group) AddEndpoint(path string, handler interface{}, hooks ...MiddlewareHook) *Endpoint {
+	endpoint, err := addEndpoint(g, path, handler, hooks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return endpoint
+}
+
+func (g *Group) insertEndpoint(path string, handler interface{}, info *handlerInfo, hooks []MiddlewareHook) (*Endpoint, error) {
+	if method, rest, ok := strings.Cut(path, "/"); ok {
+		if rest == "" && g.prefix != "" {
+			path = method + g.prefix
+		} else {
+			path = method + g.prefix + "/" + rest
+		}
+	}
+	allHooks := make([]MiddlewareHook, 0, len(g.hooks)+len(hooks))
+	allHooks = append(append(allHooks, g.hooks...), hooks...)
+	return g.parent.insertEndpoint(path, handler, info, allHooks)
+}
@@ -0,0 +1,52 @@
+package dispatch_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/olafal0/dispatch"
+)
+
+func appendHook(name string) dispatch.MiddlewareHook {
+	return func(input *dispatch.EndpointInput) (*dispatch.EndpointInput, error) {
+		input.Ctx.PathVars["hooks"] += name
+		return input, nil
+	}
+}
+
+func TestGroups(t *testing.T) {
+	api := &dispatch.API{}
+	v1 := api.Group("/v1/", appendHook("v1,"))
+	v1.AddEndpoint("GET/", func() string { return "root" })
+	admin := v1.Group("admin", appendHook("admin,"))
+	admin.AddEndpoint("GET/users/{id}", func(ctx *dispatch.Context) string {
+		return ctx.PathVars["id"] + ":" + ctx.PathVars["hooks"]
+	}, appendHook("endpoint"))
+	dispatch.Handle(admin, "POST/users", func(ctx *dispatch.Context, in struct{ Name string }) (string, error) {
+		if in.Name == "" {
+			return "", errors.New("missing name")
+		}
+		return in.Name + ":" + ctx.PathVars["hooks"], nil
+	})
+
+	tests := []struct {
+		method, path, input, expected string
+	}{
+		{"GET", "/v1", "", "root"},
+		{"GET", "/v1/admin/users/7", "", "7:v1,admin,endpoint"},
+		{"POST", "/v1/admin/users", `{"Name": "bob"}`, "bob:v1,admin,"},
+	}
+	for _, test := range tests {
+		out, err := api.Call(test.method, test.path, nil, []byte(test.input))
+		if err != nil || out != test.expected {
+			t.Errorf("%s %s: expected %s, got %v (%v)", test.method, test.path, test.expected, out, err)
+		}
+	}
+
+	if endpoint, _ := api.MatchEndpoint("GET", "/users/7"); endpoint != nil {
+		t.Errorf("unexpected match %s", endpoint.Path)
+	}
+	if len(api.Endpoints) != 3 || api.Endpoints[1].Path != "GET/v1/admin/users/{id}" {
+		t.Errorf("unexpected endpoints %v", api.Endpoints)
+	}
+}
@@ -0,0 +1,256 @@
+package dispatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+)
+
+var (
+	contextType    = reflect.TypeOf(Context{})
+	contextPtrType = reflect.TypeOf(&Context{})
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+	readerType     = reflect.TypeOf((*io.Reader)(nil)).Elem()
+	requestPtrType = reflect.TypeOf(&http.Request{})
+)
+
+// handlerInfo describes an endpoint handler. It is computed once, when the
+// endpoint is added, so that calls don't need to inspect the handler again.
+type handlerInfo struct {
+	// inputType is the type of the handler's custom input, or nil if it doesn't
+	// take one, and bindings are the request bindings of its fields.
+	inputType reflect.Type
+	bindings  []fieldBinding
+	// required is set if the input has fields tagged with `required:"true"`.
+	required bool
+
+	// streamBody is set for handlers that read the request body themselves, so
+	// that ServeHTTP doesn't read it first.
+	streamBody bool
+	// writesResponse is set for handlers that write the response themselves,
+	// so that no codec is needed for it.
+	writesResponse bool
+	// stream is set if the handler's output is a channel or iterator, which is
+	// streamed to the client, and rawOutput if it is a File or io.Reader,
+	// which is sent as the response body.
+	stream    bool
+	rawOutput bool
+	// webSocket is set for WebSocket handlers.
+	webSocket bool
+	// noOutput is set if the handler returns no output value, only an error
+	// or nothing.
+	noOutput bool
+
+	// invoke decodes the input, calls the handler, and interprets its results.
+	invoke func(ctx *Context, input json.RawMessage) (interface{}, error)
+}
+
+// newHandlerInfo checks that handler has a supported signature, as described
+// by Endpoint.Handler, and returns an invoker for it that uses reflection.
+func newHandlerInfo(handler interface{}) (*handlerInfo, error) {
+	handlerType := reflect.TypeOf(handler)
+	if handlerType == nil || handlerType.Kind() != reflect.Func {
+		return nil, fmt.Errorf("handler must be a function, not %T", handler)
+	}
+	if handlerType.IsVariadic() {
+		return nil, fmt.Errorf("handler %s must not be variadic", handlerType)
+	}
+	if isWebSocketHandler(handlerType) {
+		return newWebSocketInfo(handler)
+	}
+
+	// Handler functions can take a custom value type and/or a context input
+	numIn := handlerType.NumIn()
+	if numIn > 2 {
+		return nil, fmt.Errorf("handler %s takes too many arguments", handlerType)
+	}
+	ctxIndex, customIndex := -1, -1
+	var ctxPointer bool
+	var inputType reflect.Type
+	for i := 0; i < numIn; i++ {
+		inType := handlerType.In(i)
+		if inType == contextType || inType == contextPtrType {
+			if ctxIndex >= 0 {
+				return nil, fmt.Errorf("handler %s takes more than one context", handlerType)
+			}
+			ctxIndex = i
+			ctxPointer = inType == contextPtrType
+		} else {
+			if customIndex >= 0 {
+				return nil, fmt.Errorf("handler %s takes more than one input value", handlerType)
+			}
+			customIndex = i
+			inputType = inType
+		}
+	}
+
+	// If a value and error are returned, they must be in the order (out, error)
+	numOut := handlerType.NumOut()
+	if numOut > 2 {
+		return nil, fmt.Errorf("handler %s returns too many values", handlerType)
+	}
+	if numOut == 2 && handlerType.Out(1) != errorType {
+		return nil, fmt.Errorf("handler %s must return (output, error)", handlerType)
+	}
+
+	h, err := newInputInfo(inputType)
+	if err != nil {
+		return nil, fmt.Errorf("handler %s input: %v", handlerType, err)
+	}
+	h.stream = numOut > 0 && isStreamType(handlerType.Out(0))
+	h.rawOutput = numOut > 0 && isRawOutputType(handlerType.Out(0))
+	h.noOutput = numOut == 0 || numOut == 1 && handlerType.Out(0) == errorType
+	handlerValue := reflect.ValueOf(handler)
+	h.invoke = func(ctx *Context, input json.RawMessage) (interface{}, error) {
+		inputList := make([]reflect.Value, numIn)
+		if ctxIndex >= 0 {
+			if ctxPointer {
+				inputList[ctxIndex] = reflect.ValueOf(ctx)
+			} else {
+				inputList[ctxIndex] = reflect.ValueOf(*ctx)
+			}
+		}
+		if customIndex >= 0 {
+			inputVal := reflect.New(inputType)
+			if err := h.decode(ctx, input, inputVal.Interface()); err != nil {
+				return nil, err
+			}
+			inputList[customIndex] = inputVal.Elem()
+			defer removeFormFiles(inputVal.Elem().Interface())
+		}
+		return handlerResults(handlerValue.Call(inputList))
+	}
+	return h, nil
+}
+
+// newTypedHandlerInfo returns an invoker for a handler registered with Handle,
+// which calls it without reflection.
+func newTypedHandlerInfo[In, Out any](handler func(*Context, In) (Out, error)) (*handlerInfo, error) {
+	h, err := newInputInfo(reflect.TypeOf((*In)(nil)).Elem())
+	if err != nil {
+		return nil, fmt.Errorf("handler input: %v", err)
+	}
+	h.stream = isStreamType(reflect.TypeOf((*Out)(nil)).Elem())
+	h.rawOutput = isRawOutputType(reflect.TypeOf((*Out)(nil)).Elem())
+	h.invoke = func(ctx *Context, input json.RawMessage) (interface{}, error) {
+		var in In
+		if err := h.decode(ctx, input, &in); err != nil {
+			return nil, err
+		}
+		defer removeFormFiles(in)
+		return handler(ctx, in)
+	}
+	return h, nil
+}
+
+// newInputInfo returns a handlerInfo for a handler with the given custom input
+// type, which may be nil.
+func newInputInfo(inputType reflect.Type) (*handlerInfo, error) {
+	h := &handlerInfo{inputType: inputType}
+	switch inputType {
+	case readerType, requestPtrType, multipartFormType, multipartReaderType:
+		h.streamBody = true
+		return h, nil
+	}
+	if inputType != nil {
+		var err error
+		h.bindings, err = fieldBindings(inputType)
+		if err != nil {
+			return nil, err
+		}
+		h.required = hasRequiredFields(inputType)
+	}
+	return h, nil
+}
+
+// decode unmarshals the input into the value pointed to by dst, with the codec
+// for the request's Content-Type, then sets its bound fields from the request
+// and checks its required fields. Errors from decoding wrap ErrorBadRequest.
+func (h *handlerInfo) decode(ctx *Context, input json.RawMessage, dst interface{}) error {
+	if h.streamBody {
+		v, err := streamInput(h.inputType, ctx, input)
+		if err != nil {
+			return err
+		}
+		reflect.ValueOf(dst).Elem().Set(v)
+		return nil
+	}
+	opts := ctx.decodeOptions
+	if opts == nil {
+		opts = &DecodeOptions{}
+	}
+	// Inputs bound from the request may be sent without a body
+	if len(input) > 0 || len(h.bindings) == 0 && !opts.AllowEmptyBody {
+		codec, err := ctx.requestCodec()
+		if err != nil {
+			return err
+		}
+		if _, ok := codec.(JSONCodec); ok {
+			err = decodeJSON(input, dst, opts)
+		} else if err = codec.Unmarshal(input, dst); err != nil {
+			var httpErr *HTTPError
+			if !errors.As(err, &httpErr) {
+				err = fmt.Errorf("%w: %v", ErrorBadRequest, err)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(h.bindings) > 0 {
+		if err := bindFields(reflect.ValueOf(dst).Elem(), h.bindings, ctx); err != nil {
+			return err
+		}
+	}
+	if h.required {
+		return checkRequired(reflect.ValueOf(dst).Elem(), "")
+	}
+	return nil
+}
+
+// streamInput returns the value for an input of type io.Reader,
+// *http.Request, *multipart.Form or *multipart.Reader. These read the request
+// body directly, unless the input was already read, such as when API.Call is
+// used with an input.
+func streamInput(t reflect.Type, ctx *Context, input json.RawMessage) (reflect.Value, error) {
+	switch t {
+	case requestPtrType:
+		return reflect.ValueOf(ctx.Request), nil
+	case multipartFormType, multipartReaderType:
+		return multipartInput(t, ctx, input)
+	}
+	if input == nil && ctx.Request != nil && ctx.Request.Body != nil {
+		return reflect.ValueOf(ctx.Request.Body), nil
+	}
+	return reflect.ValueOf(bytes.NewReader(input)), nil
+}
+
+// handlerResults interprets the values returned by a handler.
+func handlerResults(resultValues []reflect.Value) (interface{}, error) {
+	switch len(resultValues) {
+	case 2:
+		out := resultValues[0].Interface()
+		if errVal := resultValues[1].Interface(); errVal != nil {
+			return out, errVal.(error)
+		}
+		return out, nil
+	case 1:
+		// Function may return _either_ an error or a value
+		retval := resultValues[0].Interface()
+		// If nil, it doesn't matter
+		if retval == nil {
+			return nil, nil
+		}
+		// Otherwise, check if it can be asserted as an error
+		if returnErr, ok := retval.(error); ok {
+			return nil, returnErr
+		}
+		// Otherwise, assume it's data
+		return retval, nil
+	}
+	return nil, nil
+}
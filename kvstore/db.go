@@ -2,15 +2,28 @@ package kvstore
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"database/sql"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"strings"
 
 	// Import sqlite3 database driver
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// ErrETagMismatch is returned by the IfMatch methods when the stored value
+// doesn't have any of the expected ETags, or doesn't exist.
+var ErrETagMismatch = errors.New("kvstore: ETag does not match")
+
 // KeyValueDB is an object similar to sql.DB that provides simple methods for create,
 // read, update, and delete functionality on key-value items.
+//
+// Like sql.DB, each method has a variant ending in Context, which stops waiting
+// for the database when the context is canceled. A *dispatch.Context can be
+// passed as the context.
 type KeyValueDB struct {
 	db *sql.DB
 }
@@ -26,11 +39,18 @@ func NewDB(name string) (kv *KeyValueDB, err error) {
 		table_name TEXT NOT NULL,
 		id TEXT NOT NULL,
 		val BLOB,
+		etag TEXT,
 		PRIMARY KEY (table_name, id)
 	);`)
 	if err != nil {
 		return nil, err
 	}
+	// Tables created by earlier versions don't have the etag column
+	if _, err = db.Exec("SELECT etag FROM kv LIMIT 0"); err != nil {
+		if _, err = db.Exec("ALTER TABLE kv ADD COLUMN etag TEXT"); err != nil {
+			return nil, err
+		}
+	}
 
 	kv = &KeyValueDB{db}
 	return kv, nil
@@ -38,16 +58,19 @@ func NewDB(name string) (kv *KeyValueDB, err error) {
 
 // SetObject creates or updates the key-value pair.
 func (kv *KeyValueDB) SetObject(table, id string, value interface{}) error {
-	gobBuffer := new(bytes.Buffer)
-	gobEncoder := gob.NewEncoder(gobBuffer)
-	err := gobEncoder.Encode(value)
+	return kv.SetObjectContext(context.Background(), table, id, value)
+}
+
+// SetObjectContext creates or updates the key-value pair.
+func (kv *KeyValueDB) SetObjectContext(ctx context.Context, table, id string, value interface{}) error {
+	val, etag, err := encodeValue(value)
 	if err != nil {
 		return err
 	}
 
-	_, err = kv.db.Exec(
-		"INSERT OR REPLACE INTO kv (table_name, id, val) VALUES(?, ?, ?);",
-		table, id, gobBuffer.Bytes(),
+	_, err = kv.db.ExecContext(ctx,
+		"INSERT OR REPLACE INTO kv (table_name, id, val, etag) VALUES(?, ?, ?, ?);",
+		table, id, val, etag,
 	)
 	if err != nil {
 		return err
@@ -56,14 +79,60 @@ func (kv *KeyValueDB) SetObject(table, id string, value interface{}) error {
 	return nil
 }
 
+// SetObjectIfMatch updates the key-value pair if its stored value has one of
+// the given ETags, and returns the ETag of the new value. See
+// SetObjectIfMatchContext.
+func (kv *KeyValueDB) SetObjectIfMatch(table, id string, value interface{}, ifMatch string) (string, error) {
+	return kv.SetObjectIfMatchContext(context.Background(), table, id, value, ifMatch)
+}
+
+// SetObjectIfMatchContext updates the key-value pair if its stored value has
+// one of the ETags listed in ifMatch, and returns the ETag of the new value.
+// ifMatch has the format of an If-Match header, so the header of a request can
+// be passed unchanged: "*" matches any stored value, and an empty ifMatch
+// creates or updates the pair unconditionally. If the stored value doesn't
+// match, ErrETagMismatch is returned. The comparison and update are atomic.
+func (kv *KeyValueDB) SetObjectIfMatchContext(ctx context.Context, table, id string, value interface{}, ifMatch string) (string, error) {
+	val, etag, err := encodeValue(value)
+	if err != nil {
+		return "", err
+	}
+	if ifMatch == "" {
+		_, err = kv.db.ExecContext(ctx,
+			"INSERT OR REPLACE INTO kv (table_name, id, val, etag) VALUES(?, ?, ?, ?);",
+			table, id, val, etag,
+		)
+		if err != nil {
+			return "", err
+		}
+		return etag, nil
+	}
+
+	condition, tags, err := etagCondition(ifMatch)
+	if err != nil {
+		return "", err
+	}
+	args := append([]interface{}{val, etag, table, id}, tags...)
+	result, err := kv.db.ExecContext(ctx, "UPDATE kv SET val = ?, etag = ? WHERE table_name = ? AND id = ?"+condition, args...)
+	if err != nil {
+		return "", err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return "", err
+	} else if n == 0 {
+		return "", ErrETagMismatch
+	}
+	return etag, nil
+}
+
 // GetObject retrieves and decodes the stored value into result.
 func (kv *KeyValueDB) GetObject(table, id string, result interface{}) (err error) {
-	row := kv.db.QueryRow(
-		"SELECT val FROM kv WHERE table_name = ? AND id = ?",
-		table, id,
-	)
-	var buf []byte
-	err = row.Scan(&buf)
+	return kv.GetObjectContext(context.Background(), table, id, result)
+}
+
+// GetObjectContext retrieves and decodes the stored value into result.
+func (kv *KeyValueDB) GetObjectContext(ctx context.Context, table, id string, result interface{}) (err error) {
+	buf, err := kv.getValue(ctx, table, id)
 	if err != nil {
 		return err
 	}
@@ -76,13 +145,182 @@ func (kv *KeyValueDB) GetObject(table, id string, result interface{}) (err error
 
 // DeleteObject removes an object from the database.
 func (kv *KeyValueDB) DeleteObject(table, id string) (err error) {
-	_, err = kv.db.Exec(
+	return kv.DeleteObjectContext(context.Background(), table, id)
+}
+
+// DeleteObjectContext removes an object from the database.
+func (kv *KeyValueDB) DeleteObjectContext(ctx context.Context, table, id string) (err error) {
+	_, err = kv.db.ExecContext(ctx,
 		"DELETE FROM kv WHERE table_name = ? AND id = ?",
 		table, id,
 	)
 	return err
 }
 
+// DeleteObjectIfMatch removes an object from the database if its stored value
+// has one of the given ETags. See DeleteObjectIfMatchContext.
+func (kv *KeyValueDB) DeleteObjectIfMatch(table, id, ifMatch string) error {
+	return kv.DeleteObjectIfMatchContext(context.Background(), table, id, ifMatch)
+}
+
+// DeleteObjectIfMatchContext removes an object from the database if its stored
+// value has one of the ETags listed in ifMatch, which has the format of an
+// If-Match header. "*" matches any stored value, and an empty ifMatch removes
+// the object unconditionally. If the stored value doesn't match,
+// ErrETagMismatch is returned.
+func (kv *KeyValueDB) DeleteObjectIfMatchContext(ctx context.Context, table, id, ifMatch string) error {
+	if ifMatch == "" {
+		return kv.DeleteObjectContext(ctx, table, id)
+	}
+	condition, tags, err := etagCondition(ifMatch)
+	if err != nil {
+		return err
+	}
+	args := append([]interface{}{table, id}, tags...)
+	result, err := kv.db.ExecContext(ctx, "DELETE FROM kv WHERE table_name = ? AND id = ?"+condition, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrETagMismatch
+	}
+	return nil
+}
+
+// GetObjectETag retrieves and decodes the stored value into result, and
+// returns its ETag. See GetObjectETagContext.
+func (kv *KeyValueDB) GetObjectETag(table, id string, result interface{}) (string, error) {
+	return kv.GetObjectETagContext(context.Background(), table, id, result)
+}
+
+// GetObjectETagContext retrieves and decodes the stored value into result, and
+// returns its ETag, a quoted string that is generated anew whenever the value
+// is written. The value and ETag are read together, so the ETag always
+// describes result. It can be sent in the ETag header of a response, and
+// compared with the If-Match header of later requests by
+// SetObjectIfMatchContext and DeleteObjectIfMatchContext.
+func (kv *KeyValueDB) GetObjectETagContext(ctx context.Context, table, id string, result interface{}) (string, error) {
+	row := kv.db.QueryRowContext(ctx,
+		"SELECT val, etag FROM kv WHERE table_name = ? AND id = ?",
+		table, id,
+	)
+	var buf []byte
+	var etag sql.NullString
+	if err := row.Scan(&buf, &etag); err != nil {
+		return "", err
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(buf)).Decode(result); err != nil {
+		return "", err
+	}
+	if etag.Valid {
+		return etag.String, nil
+	}
+
+	// Values stored by earlier versions are given an ETag when first read
+	newTag, err := newETag()
+	if err != nil {
+		return "", err
+	}
+	res, err := kv.db.ExecContext(ctx,
+		"UPDATE kv SET etag = ? WHERE table_name = ? AND id = ? AND val = ? AND etag IS NULL",
+		newTag, table, id, buf,
+	)
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if n == 0 {
+		// The value was written, or given an ETag, since it was read
+		return kv.GetObjectETagContext(ctx, table, id, result)
+	}
+	return newTag, nil
+}
+
+// getValue returns the encoded value of the key-value pair.
+func (kv *KeyValueDB) getValue(ctx context.Context, table, id string) ([]byte, error) {
+	row := kv.db.QueryRowContext(ctx,
+		"SELECT val FROM kv WHERE table_name = ? AND id = ?",
+		table, id,
+	)
+	var buf []byte
+	err := row.Scan(&buf)
+	return buf, err
+}
+
+// encodeValue returns the gob encoding of value, and a new ETag for it.
+func encodeValue(value interface{}) ([]byte, string, error) {
+	gobBuffer := new(bytes.Buffer)
+	gobEncoder := gob.NewEncoder(gobBuffer)
+	if err := gobEncoder.Encode(value); err != nil {
+		return nil, "", err
+	}
+	etag, err := newETag()
+	return gobBuffer.Bytes(), etag, err
+}
+
+// newETag returns a random ETag. Each write stores a new one, so that an ETag
+// only ever matches the value it was read with, even if a later value encodes
+// the same way.
+func newETag() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return `"` + hex.EncodeToString(b) + `"`, nil
+}
+
+// etagCondition returns an SQL condition, and its arguments, that only
+// matches stored values with one of the ETags listed in an If-Match header.
+// The W/ prefix of weak tags is ignored, as by dispatch.Context.CheckIfMatch.
+// If the header lists no valid tags, ErrETagMismatch is returned.
+func etagCondition(ifMatch string) (string, []interface{}, error) {
+	var tags []interface{}
+	for _, tag := range parseETags(ifMatch) {
+		if tag == "*" {
+			return "", nil, nil
+		}
+		tags = append(tags, strings.TrimPrefix(tag, "W/"))
+	}
+	if len(tags) == 0 {
+		return "", nil, ErrETagMismatch
+	}
+	return " AND etag IN (?" + strings.Repeat(", ?", len(tags)-1) + ")", tags, nil
+}
+
+// parseETags splits the value of an If-Match header into its entity tags,
+// including any W/ prefix, or "*". Parsing stops at the first malformed tag.
+func parseETags(header string) []string {
+	var tags []string
+	for {
+		header = strings.TrimLeft(header, " \t,")
+		if header == "" {
+			return tags
+		}
+		if header[0] == '*' {
+			tags = append(tags, "*")
+			header = header[1:]
+			continue
+		}
+		start := 0
+		if strings.HasPrefix(header, "W/") {
+			start = 2
+		}
+		if len(header) <= start || header[start] != '"' {
+			return tags
+		}
+		end := strings.IndexByte(header[start+1:], '"')
+		if end < 0 {
+			return tags
+		}
+		end += start + 2
+		tags = append(tags, header[:end])
+		header = header[end:]
+	}
+}
+
 // Table returns the KeyValueTable associated with this table name.
 func (kv *KeyValueDB) Table(table string) *KeyValueTable {
 	return &KeyValueTable{
@@ -102,16 +340,68 @@ func (kvt *KeyValueTable) GetObject(id string, result interface{}) error {
 	return kvt.db.GetObject(kvt.Table, id, result)
 }
 
+// GetObjectContext retrieves and decodes the stored value into result.
+func (kvt *KeyValueTable) GetObjectContext(ctx context.Context, id string, result interface{}) error {
+	return kvt.db.GetObjectContext(ctx, kvt.Table, id, result)
+}
+
 // SetObject creates or updates the key-value pair in this table.
 func (kvt *KeyValueTable) SetObject(id string, value interface{}) error {
 	return kvt.db.SetObject(kvt.Table, id, value)
 }
 
+// SetObjectContext creates or updates the key-value pair in this table.
+func (kvt *KeyValueTable) SetObjectContext(ctx context.Context, id string, value interface{}) error {
+	return kvt.db.SetObjectContext(ctx, kvt.Table, id, value)
+}
+
 // DeleteObject removes an object from the database.
 func (kvt *KeyValueTable) DeleteObject(id string) error {
 	return kvt.db.DeleteObject(kvt.Table, id)
 }
 
+// DeleteObjectContext removes an object from the database.
+func (kvt *KeyValueTable) DeleteObjectContext(ctx context.Context, id string) error {
+	return kvt.db.DeleteObjectContext(ctx, kvt.Table, id)
+}
+
+// SetObjectIfMatch updates the key-value pair in this table if its stored
+// value has one of the given ETags, and returns the ETag of the new value.
+func (kvt *KeyValueTable) SetObjectIfMatch(id string, value interface{}, ifMatch string) (string, error) {
+	return kvt.db.SetObjectIfMatch(kvt.Table, id, value, ifMatch)
+}
+
+// SetObjectIfMatchContext updates the key-value pair in this table if its
+// stored value has one of the given ETags, and returns the ETag of the new
+// value.
+func (kvt *KeyValueTable) SetObjectIfMatchContext(ctx context.Context, id string, value interface{}, ifMatch string) (string, error) {
+	return kvt.db.SetObjectIfMatchContext(ctx, kvt.Table, id, value, ifMatch)
+}
+
+// DeleteObjectIfMatch removes an object from the database if its stored value
+// has one of the given ETags.
+func (kvt *KeyValueTable) DeleteObjectIfMatch(id, ifMatch string) error {
+	return kvt.db.DeleteObjectIfMatch(kvt.Table, id, ifMatch)
+}
+
+// DeleteObjectIfMatchContext removes an object from the database if its stored
+// value has one of the given ETags.
+func (kvt *KeyValueTable) DeleteObjectIfMatchContext(ctx context.Context, id, ifMatch string) error {
+	return kvt.db.DeleteObjectIfMatchContext(ctx, kvt.Table, id, ifMatch)
+}
+
+// GetObjectETag retrieves and decodes the stored value into result, and
+// returns its ETag.
+func (kvt *KeyValueTable) GetObjectETag(id string, result interface{}) (string, error) {
+	return kvt.db.GetObjectETag(kvt.Table, id, result)
+}
+
+// GetObjectETagContext retrieves and decodes the stored value into result, and
+// returns its ETag.
+func (kvt *KeyValueTable) GetObjectETagContext(ctx context.Context, id string, result interface{}) (string, error) {
+	return kvt.db.GetObjectETagContext(ctx, kvt.Table, id, result)
+}
+
 // IsErrNoRows returns true if the passed error is an sql.ErrNoRows error.
 func IsErrNoRows(err error) bool {
 	return err == sql.ErrNoRows
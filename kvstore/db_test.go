@@ -1,6 +1,11 @@
 package kvstore
 
-import "testing"
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
 
 type testObj struct {
 	X map[string]string
@@ -35,3 +40,111 @@ func TestReadWrite(t *testing.T) {
 
 	db.Table("test").DeleteObject("12345")
 }
+
+func TestContextCanceled(t *testing.T) {
+	db, err := NewDB("keyvalue.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = db.Table("test").SetObjectContext(ctx, "canceled", testObj{Y: "Hello!"})
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	db, err := NewDB("keyvalue.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := db.Table("test")
+	defer table.DeleteObject("etag")
+
+	etag, err := table.SetObjectIfMatch("etag", testObj{Z: 1}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := testObj{}
+	if current, err := table.GetObjectETag("etag", &out); err != nil || current != etag || out.Z != 1 {
+		t.Errorf("Expected ETag %s, got %s %+v (%v)", etag, current, out, err)
+	}
+	// Every write changes the ETag, even if the value is the same
+	sameETag, err := table.SetObjectIfMatch("etag", testObj{Z: 1}, etag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sameETag == etag {
+		t.Error("ETag did not change")
+	}
+	etag = sameETag
+
+	newETag, err := table.SetObjectIfMatch("etag", testObj{Z: 2}, etag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newETag == etag {
+		t.Error("ETag did not change")
+	}
+	// The first ETag is now outdated
+	if _, err := table.SetObjectIfMatch("etag", testObj{Z: 3}, etag); err != ErrETagMismatch {
+		t.Errorf("Expected ErrETagMismatch, got %v", err)
+	}
+	if err := table.DeleteObjectIfMatch("etag", etag); err != ErrETagMismatch {
+		t.Errorf("Expected ErrETagMismatch, got %v", err)
+	}
+	if _, err := table.SetObjectIfMatch("etag", testObj{Z: 3}, "invalid"); err != ErrETagMismatch {
+		t.Errorf("Expected ErrETagMismatch for an invalid header, got %v", err)
+	}
+	out = testObj{}
+	if err := table.GetObject("etag", &out); err != nil || out.Z != 2 {
+		t.Errorf("Unexpected object %+v (%v)", out, err)
+	}
+
+	// Lists and weak tags are matched like If-Match headers
+	newETag, err = table.SetObjectIfMatch("etag", testObj{Z: 3}, etag+", W/"+newETag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.DeleteObjectIfMatch("etag", `"other", `+newETag); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.SetObjectIfMatch("etag", testObj{Z: 4}, "*"); err != ErrETagMismatch {
+		t.Errorf("Expected ErrETagMismatch for a missing object, got %v", err)
+	}
+}
+
+func TestETagMigration(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "old.db")
+	old, err := sql.Open("sqlite3", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	if _, err := old.Exec("CREATE TABLE kv(table_name TEXT NOT NULL, id TEXT NOT NULL, val BLOB, PRIMARY KEY (table_name, id))"); err != nil {
+		t.Fatal(err)
+	}
+	val, _, err := encodeValue(testObj{Y: "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec("INSERT INTO kv (table_name, id, val) VALUES ('test', 'old', ?)", val); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := db.Table("test")
+	out := testObj{}
+	etag, err := table.GetObjectETag("old", &out)
+	if err != nil || out.Y != "old" || etag == "" {
+		t.Fatalf("Unexpected object %+v with ETag %q (%v)", out, etag, err)
+	}
+	if _, err := table.SetObjectIfMatch("old", testObj{Y: "new"}, etag); err != nil {
+		t.Errorf("Expected ETag of old value to match, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package dispatch
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Handler is a function that handles an endpoint call, and returns its output
+// and error. Middleware wraps Handlers.
+type Handler func(in *EndpointInput) (interface{}, error)
+
+// Middleware wraps a Handler, in the style of net/http middleware. It can
+// change the input before calling next, change the output and error returned
+// by next, or return an output without calling next at all. For example, this
+// middleware logs the duration of each call:
+//
+//	func timer(next dispatch.Handler) dispatch.Handler {
+//		return func(in *dispatch.EndpointInput) (interface{}, error) {
+//			start := time.Now()
+//			defer func() { log.Printf("%s %s took %v", in.Method, in.Path, time.Since(start)) }()
+//			return next(in)
+//		}
+//	}
+//
+// MiddlewareHooks and PostResponseHooks are special cases of Middleware, and
+// can be converted with their Middleware methods.
+type Middleware func(next Handler) Handler
+
+// Middleware adapts the hook to a Middleware, which calls the hook and then
+// next with the modified input. If the hook returns an error, next is not
+// called.
+func (hook MiddlewareHook) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(in *EndpointInput) (interface{}, error) {
+			originalInput := &EndpointInput{in.Method, in.Path, in.Ctx, in.Input}
+			modifiedInput, err := hook(originalInput)
+			if err != nil {
+				return nil, err
+			}
+			// Outer middleware, such as PostResponseHooks, see the modified input
+			*in = *modifiedInput
+			return next(in)
+		}
+	}
+}
+
+// Middleware adapts the hook to a Middleware, which calls next and then passes
+// its output and error to the hook.
+func (hook PostResponseHook) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(in *EndpointInput) (interface{}, error) {
+			out, err := next(in)
+			return hook(in, out, err)
+		}
+	}
+}
+
+// chain wraps h with middleware, post-response hooks and pre-request hooks,
+// from the outside in. Within each list, earlier entries run first.
+func chain(h Handler, middleware []Middleware, pre []MiddlewareHook, post []PostResponseHook) Handler {
+	for i := len(pre) - 1; i >= 0; i-- {
+		h = pre[i].Middleware()(h)
+	}
+	// The first post-response hook sees the result first, so it is innermost
+	for _, hook := range post {
+		h = hook.Middleware()(h)
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// handlerChain caches a Handler built by chain, so that it is only built again
+// when the lists of middleware and hooks it was built from are replaced or
+// appended to, or the timeout changes. Elements of the lists are not compared,
+// since functions can't be, so changes made in place are not seen.
+type handlerChain struct {
+	built atomic.Pointer[builtChain]
+}
+
+type builtChain struct {
+	handler    Handler
+	middleware []Middleware
+	pre        []MiddlewareHook
+	post       []PostResponseHook
+	timeout    time.Duration
+}
+
+// get returns h wrapped with middleware, hooks and, if timeout is positive,
+// withTimeout.
+func (c *handlerChain) get(h Handler, middleware []Middleware, pre []MiddlewareHook, post []PostResponseHook, timeout time.Duration) Handler {
+	if b := c.built.Load(); b != nil && sameSlice(b.middleware, middleware) && sameSlice(b.pre, pre) && sameSlice(b.post, post) && b.timeout == timeout {
+		return b.handler
+	}
+	handler := chain(h, middleware, pre, post)
+	if timeout > 0 {
+		handler = withTimeout(timeout, handler)
+	}
+	c.built.Store(&builtChain{handler, middleware, pre, post, timeout})
+	return handler
+}
+
+// sameSlice reports whether a and b are the same slice of the same array.
+func sameSlice[T any](a, b []T) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
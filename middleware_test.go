@@ -0,0 +1,108 @@
+package dispatch_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/olafal0/dispatch"
+)
+
+func TestMiddleware(t *testing.T) {
+	var order []string
+	trace := func(name string) dispatch.Middleware {
+		return func(next dispatch.Handler) dispatch.Handler {
+			return func(in *dispatch.EndpointInput) (interface{}, error) {
+				order = append(order, name+" before")
+				out, err := next(in)
+				order = append(order, name+" after")
+				return out, err
+			}
+		}
+	}
+	cache := map[string]interface{}{"/items/cached": "from cache"}
+	cacheMiddleware := func(next dispatch.Handler) dispatch.Handler {
+		return func(in *dispatch.EndpointInput) (interface{}, error) {
+			if out, ok := cache[in.Path]; ok {
+				return out, nil
+			}
+			return next(in)
+		}
+	}
+	hook := dispatch.MiddlewareHook(func(in *dispatch.EndpointInput) (*dispatch.EndpointInput, error) {
+		order = append(order, "hook")
+		if in.Ctx.PathVars["id"] == "forbidden" {
+			return nil, dispatch.ErrorForbidden
+		}
+		return in, nil
+	})
+
+	api := &dispatch.API{Middleware: []dispatch.Middleware{trace("outer"), cacheMiddleware}}
+	endpoint := api.AddEndpoint("GET/items/{id}", func(ctx *dispatch.Context) string {
+		order = append(order, "handler")
+		return ctx.PathVars["id"]
+	})
+	endpoint.Middleware = []dispatch.Middleware{trace("endpoint"), hook.Middleware()}
+
+	out, err := api.Call("GET", "/items/1", nil, nil)
+	if out != "1" || err != nil {
+		t.Errorf("Unexpected result %v (%v)", out, err)
+	}
+	expected := "[outer before endpoint before hook handler endpoint after outer after]"
+	if fmt.Sprint(order) != expected {
+		t.Errorf("Unexpected order %v", order)
+	}
+
+	order = nil
+	out, err = api.Call("GET", "/items/cached", nil, nil)
+	if out != "from cache" || err != nil {
+		t.Errorf("Unexpected result %v (%v)", out, err)
+	}
+	if fmt.Sprint(order) != "[outer before outer after]" {
+		t.Errorf("Unexpected order %v", order)
+	}
+
+	order = nil
+	_, err = api.Call("GET", "/items/forbidden", nil, nil)
+	if !errors.Is(err, dispatch.ErrorForbidden) {
+		t.Errorf("Expected forbidden, got %v", err)
+	}
+	if fmt.Sprint(order) != "[outer before endpoint before hook endpoint after outer after]" {
+		t.Errorf("Unexpected order %v", order)
+	}
+}
+
+func TestMiddlewareBuiltOnce(t *testing.T) {
+	builds := 0
+	counter := func(name string) dispatch.Middleware {
+		return func(next dispatch.Handler) dispatch.Handler {
+			builds++
+			return func(in *dispatch.EndpointInput) (interface{}, error) {
+				out, err := next(in)
+				if s, ok := out.(string); ok {
+					out = s + " " + name
+				}
+				return out, err
+			}
+		}
+	}
+	api := &dispatch.API{Middleware: []dispatch.Middleware{counter("api")}}
+	endpoint := api.AddEndpoint("GET/hello", func() string { return "hello" })
+	endpoint.Middleware = []dispatch.Middleware{counter("endpoint")}
+
+	for i := 0; i < 3; i++ {
+		out, err := api.Call("GET", "/hello", nil, nil)
+		if err != nil || out != "hello endpoint api" {
+			t.Fatalf("Unexpected result %v, %v", out, err)
+		}
+	}
+	if builds != 2 {
+		t.Errorf("Expected middleware to be built once per chain, got %d builds", builds)
+	}
+
+	// Changes to the lists are picked up
+	api.Middleware = append(api.Middleware, counter("added"))
+	if out, _ := api.Call("GET", "/hello", nil, nil); out != "hello endpoint added api" {
+		t.Errorf("Unexpected result %v", out)
+	}
+}
@@ -0,0 +1,80 @@
+package dispatch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// AnyMethod can be used as the method of an endpoint path, such as
+// */proxy/{path...}, to match requests with any method. Endpoints for a
+// specific method take priority.
+const AnyMethod = "*"
+
+// setResponseWritten records that the handler writes the response itself, so
+// that ServeHTTP writes nothing more, whatever the output of the call.
+func (c *Context) setResponseWritten() {
+	if c.written != nil {
+		c.written.Store(true)
+	}
+}
+
+// responseWritten reports whether the handler has written the response itself.
+func (c *Context) responseWritten() bool {
+	return c.written != nil && c.written.Load()
+}
+
+type pathVarsKey struct{}
+
+// RequestPathVars returns the path variables of a request that was passed to a
+// mounted http.Handler.
+func RequestPathVars(r *http.Request) PathVars {
+	pathVars, _ := r.Context().Value(pathVarsKey{}).(PathVars)
+	return pathVars
+}
+
+// Mount registers a standard http.Handler as an endpoint of this API. The
+// path is in the same format as for AddEndpoint, and the method may be
+// AnyMethod. Hooks and middleware run as for any other endpoint, but the
+// handler writes the response itself, and receives the request unchanged.
+// Path variables are available from RequestPathVars.
+//
+// Mounted handlers see the full request path. To serve files from a directory,
+// strip the prefix:
+//
+//	api.Mount("GET/static/{path...}", http.StripPrefix("/static", http.FileServer(dir)))
+//
+// Mounted handlers can only be called through ServeHTTP, since they need an
+// http.ResponseWriter.
+func (api *API) Mount(path string, handler http.Handler, hooks ...MiddlewareHook) *Endpoint {
+	return mount(api, path, handler, hooks)
+}
+
+// Mount registers a standard http.Handler as an endpoint of the group's API,
+// with the group's prefix and hooks. See API.Mount.
+func (g *Group) Mount(path string, handler http.Handler, hooks ...MiddlewareHook) *Endpoint {
+	return mount(g, path, handler, hooks)
+}
+
+func mount(routes Routes, path string, handler http.Handler, hooks []MiddlewareHook) *Endpoint {
+	info := &handlerInfo{
+		streamBody:     true,
+		writesResponse: true,
+		invoke: func(ctx *Context, input json.RawMessage) (interface{}, error) {
+			if ctx.Request == nil || ctx.Writer == nil {
+				return nil, errors.New("Mounted handlers require an HTTP request")
+			}
+			r := ctx.Request.WithContext(context.WithValue(ctx.Request.Context(), pathVarsKey{}, ctx.PathVars))
+			ctx.setResponseWritten()
+			handler.ServeHTTP(ctx.Writer, r)
+			return nil, nil
+		},
+	}
+	endpoint, err := routes.insertEndpoint(path, handler, info, hooks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return endpoint
+}
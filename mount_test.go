@@ -0,0 +1,87 @@
+package dispatch_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/olafal0/dispatch"
+)
+
+func TestMount(t *testing.T) {
+	api := &dispatch.API{}
+	api.AddEndpoint("GET/proxy/status", func() string { return "ok" })
+	api.Mount("*/proxy/{path...}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, r.Method+" "+dispatch.RequestPathVars(r)["path"]+" "+string(body))
+	}))
+	admin := api.Group("/admin", func(in *dispatch.EndpointInput) (*dispatch.EndpointInput, error) {
+		if in.Ctx.Request.Header.Get("X-Admin") == "" {
+			return nil, dispatch.ErrorForbidden
+		}
+		return in, nil
+	})
+	admin.Mount("GET/files/{path...}", http.StripPrefix("/admin/files", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	})))
+
+	rec := doRequest(api.ServeHTTP, "POST", "/proxy/a/b", "hello")
+	if rec.Code != http.StatusAccepted || rec.Body.String() != "POST a/b hello" {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	// Endpoints for a specific method take priority
+	rec = doRequest(api.ServeHTTP, "GET", "/proxy/status", "")
+	if rec.Body.String() != `"ok"` {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	rec = doRequest(api.ServeHTTP, "DELETE", "/proxy/status", "")
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	if methods := api.AllowedMethods("/proxy/status"); strings.Join(methods, ",") != "GET,HEAD" {
+		t.Errorf("Unexpected allowed methods %v", methods)
+	}
+
+	rec = doRequest(api.ServeHTTP, "GET", "/admin/files/x.txt", "")
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected forbidden, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	req := httptest.NewRequest("GET", "/admin/files/x.txt", nil)
+	req.Header.Set("X-Admin", "yes")
+	rec = httptest.NewRecorder()
+	// API is an http.Handler, so it can be wrapped by standard middleware
+	http.TimeoutHandler(api, time.Second, "timeout").ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "/x.txt" {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	_, err := api.Call("GET", "/admin/files/x.txt", &dispatch.Context{Request: req}, nil)
+	if err == nil {
+		t.Error("Expected error calling mounted handler without a request")
+	}
+}
+
+func TestMountReplacedOutput(t *testing.T) {
+	api := &dispatch.API{
+		PostResponseHooks: []dispatch.PostResponseHook{
+			func(in *dispatch.EndpointInput, out interface{}, err error) (interface{}, error) {
+				return map[string]interface{}{"wrapped": out}, err
+			},
+		},
+	}
+	api.Mount("GET/raw", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "raw")
+	}))
+
+	rec := doRequest(api.ServeHTTP, "GET", "/raw", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "raw" {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -2,30 +2,78 @@ package dispatch
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
 // PathVars is an alias for map[string]string, used for captured path variables.
 type PathVars map[string]string
 
+// Int returns the named path variable as an integer. If the variable is
+// missing or is not an integer, the returned error wraps ErrorBadRequest.
+func (p PathVars) Int(name string) (int, error) {
+	i, err := strconv.Atoi(p[name])
+	if err != nil {
+		return 0, fmt.Errorf("%w: path variable %s must be an integer", ErrorBadRequest, name)
+	}
+	return i, nil
+}
+
+// UUID returns the named path variable as a lowercase UUID string. If the
+// variable is missing or is not a UUID, the returned error wraps
+// ErrorBadRequest.
+func (p PathVars) UUID(name string) (string, error) {
+	s := p[name]
+	if !isUUID(s) {
+		return "", fmt.Errorf("%w: path variable %s must be a UUID", ErrorBadRequest, name)
+	}
+	return strings.ToLower(s), nil
+}
+
 // An APIPath represents a specified path and method, such as GET/users/{uuid}.
 type APIPath struct {
 	PathParts []string
 	Method    string
+
+	// vars holds the parsed path variable for each of PathParts, or nil for
+	// literal parts.
+	vars []*pathVar
 }
 
 // NewAPIPath creates an APIPath object from a path string, in the format
 // GET/users/{uuid}.
+//
+// The last part of the path may be a catch-all variable, in the format
+// GET/files/{path...}, which captures the remainder of the request path,
+// slashes included.
+//
+// Path variables may be constrained, in the format {name:constraint}. The
+// constraint is either int, uuid, or a regular expression that must match the
+// whole path part, such as {slug:[a-z-]+}. A path whose variables do not
+// satisfy their constraints is not a match.
 func NewAPIPath(path string) (*APIPath, error) {
 	parts := strings.Split(path, "/")
 	// path must have at least a method and one slash
 	if len(parts) < 2 {
 		return nil, fmt.Errorf("Invalid path: %s", path)
 	}
-	return &APIPath{
+	apiPath := &APIPath{
 		Method:    parts[0],
 		PathParts: parts[1:],
-	}, nil
+		vars:      make([]*pathVar, len(parts)-1),
+	}
+	for i, part := range apiPath.PathParts {
+		v, err := parsePathVar(part)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid path: %s: %v", path, err)
+		}
+		if v != nil && v.catchAll && i != len(apiPath.PathParts)-1 {
+			return nil, fmt.Errorf("Invalid path: %s: catch-all variable must be last, found at part %d", path, i+1)
+		}
+		apiPath.vars[i] = v
+	}
+	return apiPath, nil
 }
 
 // Match tests an APIPath against a path string, and returns a map of path
@@ -38,20 +86,92 @@ func (a *APIPath) Match(method, path string) (pathVars PathVars, ok bool) {
 		path = path[1:]
 	}
 	parts := strings.Split(path, "/")
-	if len(parts) != len(a.PathParts) {
+	if len(parts) < len(a.PathParts) {
 		return
 	}
 
 	pathVars = make(map[string]string)
-	for i, p := range parts {
-		apiPart := a.PathParts[i]
-		if len(apiPart) > 1 && apiPart[0] == '{' && apiPart[len(apiPart)-1] == '}' {
+	for i, apiPart := range a.PathParts {
+		p := parts[i]
+		if v := a.pathVar(i); v != nil {
 			// This path part is a path variable
-			pathVars[apiPart[1:len(apiPart)-1]] = p
+			if v.catchAll {
+				pathVars[v.name] = strings.Join(parts[i:], "/")
+				return pathVars, true
+			}
+			if !v.matches(p) {
+				return nil, false
+			}
+			pathVars[v.name] = p
 		} else if p != apiPart {
 			// If not a path variable, and they don't match, this path is incorrect
 			return nil, false
 		}
 	}
+	if len(parts) != len(a.PathParts) {
+		return nil, false
+	}
 	return pathVars, true
 }
+
+// pathVar returns the parsed path variable of the path part at index i, or nil
+// if it is a literal.
+func (a *APIPath) pathVar(i int) *pathVar {
+	if len(a.vars) == len(a.PathParts) {
+		return a.vars[i]
+	}
+	// The APIPath was not created with NewAPIPath, so parse it on demand
+	v, _ := parsePathVar(a.PathParts[i])
+	return v
+}
+
+// pathVar is a parsed path variable.
+type pathVar struct {
+	name string
+	// catchAll is set for variables like {path...}, which capture all remaining
+	// path parts.
+	catchAll bool
+	// constraint is the constraint after the colon in {name:constraint}, and
+	// pattern is its compiled form.
+	constraint string
+	pattern    *regexp.Regexp
+}
+
+// Patterns used for named path variable constraints.
+var namedConstraints = map[string]*regexp.Regexp{
+	"int":  regexp.MustCompile(`^-?[0-9]+$`),
+	"uuid": regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`),
+}
+
+// parsePathVar parses a path part in curly brace notation. It returns nil if
+// the part is not a path variable.
+func parsePathVar(part string) (*pathVar, error) {
+	if len(part) < 2 || part[0] != '{' || part[len(part)-1] != '}' {
+		return nil, nil
+	}
+	v := &pathVar{name: part[1 : len(part)-1]}
+	if i := strings.IndexByte(v.name, ':'); i >= 0 {
+		v.name, v.constraint = v.name[:i], v.name[i+1:]
+		v.pattern = namedConstraints[v.constraint]
+		if v.pattern == nil {
+			var err error
+			v.pattern, err = regexp.Compile("^(?:" + v.constraint + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid constraint for %s: %v", v.name, err)
+			}
+		}
+	} else if strings.HasSuffix(v.name, "...") {
+		v.name = strings.TrimSuffix(v.name, "...")
+		v.catchAll = true
+	}
+	return v, nil
+}
+
+// matches reports whether a path part satisfies the variable's constraint.
+func (v *pathVar) matches(part string) bool {
+	return v.pattern == nil || v.pattern.MatchString(part)
+}
+
+func isUUID(s string) bool {
+	return namedConstraints["uuid"].MatchString(s)
+}
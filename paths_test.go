@@ -1,6 +1,7 @@
 package dispatch_test
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/olafal0/dispatch"
@@ -63,3 +64,102 @@ func TestPathVariables(t *testing.T) {
 		t.Errorf("Incorrect path var %s", pathVars["foo"])
 	}
 }
+
+func TestPathCatchAll(t *testing.T) {
+	_, err := dispatch.NewAPIPath("GET/files/{path...}/meta")
+	if err == nil {
+		t.Error("Expected error for catch-all that is not last")
+	}
+
+	apiPath, err := dispatch.NewAPIPath("GET/files/{path...}")
+	if err != nil {
+		t.Error(err)
+	}
+
+	pathVars, match := apiPath.Match("GET", "/files/css/site.css")
+	if !match {
+		t.Error("match should have been true")
+	}
+	if pathVars["path"] != "css/site.css" {
+		t.Errorf("Incorrect path var %s", pathVars["path"])
+	}
+
+	pathVars, match = apiPath.Match("GET", "/files/")
+	if !match || pathVars["path"] != "" {
+		t.Errorf("Expected empty match, got %v %v", match, pathVars)
+	}
+
+	_, match = apiPath.Match("GET", "/files")
+	if match {
+		t.Error("match should have been false")
+	}
+}
+
+func TestPathConstraints(t *testing.T) {
+	_, err := dispatch.NewAPIPath("GET/users/{id:[0-9}")
+	if err == nil {
+		t.Error("Expected error for invalid constraint")
+	}
+
+	apiPath, err := dispatch.NewAPIPath("GET/users/{id:int}/posts/{slug:[a-z-]+}")
+	if err != nil {
+		t.Error(err)
+	}
+
+	pathVars, match := apiPath.Match("GET", "/users/42/posts/hello-world")
+	if !match {
+		t.Error("match should have been true")
+	}
+	if pathVars["id"] != "42" || pathVars["slug"] != "hello-world" {
+		t.Errorf("Incorrect path vars %v", pathVars)
+	}
+
+	_, match = apiPath.Match("GET", "/users/abc/posts/hello-world")
+	if match {
+		t.Error("match should have been false")
+	}
+
+	_, match = apiPath.Match("GET", "/users/42/posts/Hello")
+	if match {
+		t.Error("match should have been false")
+	}
+
+	apiPath, err = dispatch.NewAPIPath("GET/items/{id:uuid}")
+	if err != nil {
+		t.Error(err)
+	}
+	_, match = apiPath.Match("GET", "/items/6BA7B810-9DAD-11D1-80B4-00C04FD430C8")
+	if !match {
+		t.Error("match should have been true")
+	}
+	_, match = apiPath.Match("GET", "/items/6ba7b810-9dad-11d1-80b4")
+	if match {
+		t.Error("match should have been false")
+	}
+}
+
+func TestPathVarAccessors(t *testing.T) {
+	pathVars := dispatch.PathVars{
+		"id":   "42",
+		"uuid": "6BA7B810-9DAD-11D1-80B4-00C04FD430C8",
+		"bad":  "x",
+	}
+
+	id, err := pathVars.Int("id")
+	if id != 42 || err != nil {
+		t.Errorf("Expected 42, got %d (%v)", id, err)
+	}
+	_, err = pathVars.Int("bad")
+	if !errors.Is(err, dispatch.ErrorBadRequest) {
+		t.Errorf("Expected bad request, got %v", err)
+	}
+
+	uuid, err := pathVars.UUID("uuid")
+	if uuid != "6ba7b810-9dad-11d1-80b4-00c04fd430c8" || err != nil {
+		t.Errorf("Incorrect UUID %s (%v)", uuid, err)
+	}
+	_, err = pathVars.UUID("missing")
+	if !errors.Is(err, dispatch.ErrorBadRequest) {
+		t.Errorf("Expected bad request, got %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package dispatch
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	responseType    = reflect.TypeOf(Response{})
+	responsePtrType = reflect.TypeOf(&Response{})
+)
+
+// A Responder is a handler output that sets the status code or headers of its
+// response. Outputs can implement it directly, or embed Response.
+type Responder interface {
+	// StatusCode returns the status of the response, or 0 for 200 OK.
+	StatusCode() int
+	// ResponseHeader returns headers to add to the response, or nil.
+	ResponseHeader() http.Header
+}
+
+// Response sets the status code, headers and cookies of a response. It can be
+// embedded in an output type, whose other fields are encoded as the body:
+//
+//	type Created struct {
+//		dispatch.Response
+//		ID string `json:"id"`
+//	}
+//
+//	out := Created{ID: id}
+//	out.SetStatus(http.StatusCreated)
+//	out.Header().Set("Location", "/users/"+id)
+//	return out, nil
+//
+// A Response returned on its own has no body, and its status defaults to 204
+// No Content.
+type Response struct {
+	status int
+	header http.Header
+}
+
+// NewResponse returns a Response with the given status, such as
+// http.StatusAccepted.
+func NewResponse(status int) *Response {
+	return &Response{status: status}
+}
+
+// SetStatus sets the status code of the response.
+func (r *Response) SetStatus(status int) {
+	r.status = status
+}
+
+// Header returns the headers of the response, which can be modified.
+func (r *Response) Header() http.Header {
+	if r.header == nil {
+		r.header = make(http.Header)
+	}
+	return r.header
+}
+
+// SetCookie adds a Set-Cookie header to the response.
+func (r *Response) SetCookie(cookie *http.Cookie) {
+	if v := cookie.String(); v != "" {
+		r.Header().Add("Set-Cookie", v)
+	}
+}
+
+// SetETag sets the ETag header of the response, which identifies the version
+// of the resource it represents. The tag is quoted if it isn't already. GET
+// requests with a matching If-None-Match header receive 304 Not Modified.
+func (r *Response) SetETag(etag string) {
+	if !strings.HasSuffix(etag, `"`) {
+		etag = `"` + etag + `"`
+	}
+	r.Header().Set("ETag", etag)
+}
+
+// SetLastModified sets the Last-Modified header of the response. GET requests
+// with an If-Modified-Since header that is not before t receive 304 Not
+// Modified.
+func (r *Response) SetLastModified(t time.Time) {
+	r.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+}
+
+// StatusCode implements Responder.
+func (r Response) StatusCode() int {
+	return r.status
+}
+
+// ResponseHeader implements Responder.
+func (r Response) ResponseHeader() http.Header {
+	return r.header
+}
+
+// writeResponse adds the headers of a successful output to the response, and
+// returns its status. If the output has no body, the status is written, and
+// done is true. Outputs without a body are Responses on their own, outputs
+// with a status that must not have a body, and the nil output of a handler
+// that returns no output value, as reported by noOutput. Other nil outputs are
+// encoded as usual.
+func writeResponse(w http.ResponseWriter, output interface{}, noOutput bool) (status int, done bool) {
+	// Nil pointers to types that embed Response are encoded as usual
+	if responder, ok := output.(Responder); ok && !isNilPointer(output) {
+		for name, values := range responder.ResponseHeader() {
+			for _, v := range values {
+				w.Header().Add(name, v)
+			}
+		}
+		status = responder.StatusCode()
+	}
+	bodiless := output == nil && noOutput
+	switch output.(type) {
+	case Response, *Response:
+		bodiless = true
+	}
+	if bodiless {
+		if status == 0 {
+			status = http.StatusNoContent
+		}
+		w.WriteHeader(status)
+		return status, true
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		w.WriteHeader(status)
+		return status, true
+	}
+	return status, false
+}
+
+func isNilPointer(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	return rv.Kind() == reflect.Ptr && rv.IsNil()
+}
@@ -0,0 +1,61 @@
+package dispatch_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/olafal0/dispatch"
+)
+
+type createdUser struct {
+	dispatch.Response
+	ID string `json:"id"`
+}
+
+func TestResponse(t *testing.T) {
+	api := &dispatch.API{}
+	api.AddEndpoint("POST/users", func() createdUser {
+		out := createdUser{ID: "42"}
+		out.SetStatus(http.StatusCreated)
+		out.Header().Set("Location", "/users/42")
+		out.SetCookie(&http.Cookie{Name: "session", Value: "abc"})
+		return out
+	})
+	api.AddEndpoint("POST/jobs", func() *dispatch.Response {
+		return dispatch.NewResponse(http.StatusAccepted)
+	})
+	api.AddEndpoint("DELETE/users/{id}", func(ctx *dispatch.Context) error { return nil })
+	api.AddEndpoint("GET/users/{id}", func(ctx *dispatch.Context) (*createdUser, error) { return nil, nil })
+	api.AddEndpoint("GET/anything", func() interface{} { return nil })
+
+	rec := doRequest(api.ServeHTTP, "POST", "/users", "")
+	if rec.Code != http.StatusCreated || rec.Body.String() != `{"id":"42"}` {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Location") != "/users/42" || rec.Header().Get("Set-Cookie") != "session=abc" {
+		t.Errorf("Unexpected headers %v", rec.Header())
+	}
+
+	rec = doRequest(api.ServeHTTP, "POST", "/jobs", "")
+	if rec.Code != http.StatusAccepted || rec.Body.Len() != 0 {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	// Handlers without an output respond with No Content
+	rec = doRequest(api.ServeHTTP, "DELETE", "/users/42", "")
+	if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	// A nil value of an output type is still encoded
+	rec = doRequest(api.ServeHTTP, "GET", "/users/42", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "null" {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+
+	// So is a nil output from a handler that returns an interface
+	rec = doRequest(api.ServeHTTP, "GET", "/anything", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "null" {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,216 @@
+package dispatch
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// router is a prefix tree of registered endpoints, with one tree per method.
+// Each node in a tree represents a single path segment, so the cost of a lookup
+// depends on the depth of the path rather than on the number of endpoints.
+type router struct {
+	trees     map[string]*routeNode
+	conflicts RouteConflicts
+}
+
+// A RouteConflict describes an endpoint that can never be matched, because an
+// endpoint registered before it matches exactly the same requests.
+type RouteConflict struct {
+	// Path is the path of the endpoint that can never be matched.
+	Path string
+	// Existing is the path of the endpoint that is matched instead.
+	Existing string
+}
+
+func (c *RouteConflict) Error() string {
+	if c.Path == c.Existing {
+		return fmt.Sprintf("Duplicate endpoint %s", c.Path)
+	}
+	return fmt.Sprintf("Endpoint %s is ambiguous with %s", c.Path, c.Existing)
+}
+
+// RouteConflicts is the error type returned by API.Validate.
+type RouteConflicts []*RouteConflict
+
+func (c RouteConflicts) Error() string {
+	msgs := make([]string, len(c))
+	for i, conflict := range c {
+		msgs[i] = conflict.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// routeNode is a single path segment in a route tree. Static children are
+// always tried before path variable children, so GET/users/me takes priority
+// over GET/users/{id} regardless of registration order. The catch-all child is
+// tried last.
+type routeNode struct {
+	static   map[string]*routeNode
+	params   []*routeNode
+	catchAll *routeNode
+
+	// constraint is set on path variable nodes whose variable is constrained.
+	constraint *pathVar
+
+	// endpoint and varNames are only set on nodes that terminate a route.
+	endpoint *Endpoint
+	varNames []string
+}
+
+// insert adds an endpoint to the tree for its method. If an endpoint with an
+// identical path structure has already been added, the existing endpoint is
+// kept, and the conflict is recorded and returned.
+func (r *router) insert(endpoint *Endpoint) *RouteConflict {
+	if r.trees == nil {
+		r.trees = make(map[string]*routeNode)
+	}
+	apiPath := endpoint.pathMatcher
+	n := r.trees[apiPath.Method]
+	if n == nil {
+		n = &routeNode{}
+		r.trees[apiPath.Method] = n
+	}
+
+	var varNames []string
+	for i, part := range apiPath.PathParts {
+		if v := apiPath.pathVar(i); v != nil {
+			if v.catchAll {
+				if n.catchAll == nil {
+					n.catchAll = &routeNode{}
+				}
+				n = n.catchAll
+			} else {
+				n = n.paramChild(v)
+			}
+			varNames = append(varNames, v.name)
+			continue
+		}
+		if n.static == nil {
+			n.static = make(map[string]*routeNode)
+		}
+		child := n.static[part]
+		if child == nil {
+			child = &routeNode{}
+			n.static[part] = child
+		}
+		n = child
+	}
+
+	if n.endpoint != nil {
+		conflict := &RouteConflict{Path: endpoint.Path, Existing: n.endpoint.Path}
+		r.conflicts = append(r.conflicts, conflict)
+		return conflict
+	}
+	n.endpoint = endpoint
+	n.varNames = varNames
+	return nil
+}
+
+// paramChild returns the path variable child of n for the constraint of v,
+// creating it if needed. Children are kept in the order they are tried, which
+// does not depend on registration order: named constraints such as int and
+// uuid first, then regular expressions, then unconstrained variables, and
+// children of the same kind in order of their constraint's text.
+func (n *routeNode) paramChild(v *pathVar) *routeNode {
+	for _, param := range n.params {
+		if param.constraintString() == v.constraint {
+			return param
+		}
+	}
+	child := &routeNode{}
+	if v.constraint != "" {
+		child.constraint = v
+	}
+	n.params = append(n.params, child)
+	sort.SliceStable(n.params, func(i, j int) bool {
+		a, b := n.params[i], n.params[j]
+		if a.constraintRank() != b.constraintRank() {
+			return a.constraintRank() < b.constraintRank()
+		}
+		return a.constraintString() < b.constraintString()
+	})
+	return child
+}
+
+// constraintRank orders path variable children by the kind of their
+// constraint: 0 for named constraints, 1 for regular expressions, and 2 for
+// unconstrained variables.
+func (n *routeNode) constraintRank() int {
+	switch {
+	case n.constraint == nil:
+		return 2
+	case namedConstraints[n.constraint.constraint] != nil:
+		return 0
+	}
+	return 1
+}
+
+func (n *routeNode) constraintString() string {
+	if n.constraint == nil {
+		return ""
+	}
+	return n.constraint.constraint
+}
+
+// match finds the endpoint for a method and request path, along with the
+// values of any path variables.
+func (r *router) match(method, path string) (*Endpoint, PathVars) {
+	root := r.trees[method]
+	if root == nil {
+		return nil, nil
+	}
+	if len(path) > 0 && path[0] == '/' {
+		path = path[1:]
+	}
+
+	leaf, values := root.lookup(path, nil)
+	if leaf == nil {
+		return nil, nil
+	}
+	pathVars := make(PathVars, len(values))
+	for i, name := range leaf.varNames {
+		pathVars[name] = values[i]
+	}
+	return leaf.endpoint, pathVars
+}
+
+// lookup matches the first segment of path against the children of n, and
+// recurses on the remainder. Path variable values are appended to values in
+// the order they appear in the path. If a static child leads to a dead end,
+// lookup backtracks and tries the path variable child instead.
+func (n *routeNode) lookup(path string, values []string) (*routeNode, []string) {
+	segment, rest, last := path, "", true
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		segment, rest, last = path[:i], path[i+1:], false
+	}
+
+	if child := n.static[segment]; child != nil {
+		if leaf, v := child.next(rest, last, values); leaf != nil {
+			return leaf, v
+		}
+	}
+	for _, param := range n.params {
+		if param.constraint != nil && !param.constraint.matches(segment) {
+			continue
+		}
+		if leaf, v := param.next(rest, last, append(values, segment)); leaf != nil {
+			return leaf, v
+		}
+	}
+	if n.catchAll != nil && n.catchAll.endpoint != nil {
+		return n.catchAll, append(values, path)
+	}
+	return nil, values
+}
+
+// next continues a lookup from n, which has just matched a segment.
+func (n *routeNode) next(rest string, last bool, values []string) (*routeNode, []string) {
+	if last {
+		if n.endpoint != nil {
+			return n, values
+		}
+		return nil, values
+	}
+	return n.lookup(rest, values)
+}
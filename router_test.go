@@ -0,0 +1,194 @@
+package dispatch_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/olafal0/dispatch"
+)
+
+func TestRouterPrecedence(t *testing.T) {
+	api := dispatch.API{}
+	api.AddEndpoint("GET/users/{id}", func() string { return "id" })
+	api.AddEndpoint("GET/users/me", func() string { return "me" })
+	api.AddEndpoint("GET/users/me/posts/{post}", func() string { return "posts" })
+	api.AddEndpoint("GET/users/{id}/likes", func() string { return "likes" })
+
+	tests := []struct {
+		path     string
+		expected string
+		vars     dispatch.PathVars
+	}{
+		{"/users/me", "me", dispatch.PathVars{}},
+		{"/users/1234", "id", dispatch.PathVars{"id": "1234"}},
+		{"/users/me/posts/5", "posts", dispatch.PathVars{"post": "5"}},
+		// The static "me" branch has no likes route, so this must backtrack
+		{"/users/me/likes", "likes", dispatch.PathVars{"id": "me"}},
+	}
+	for _, test := range tests {
+		endpoint, vars := api.MatchEndpoint("GET", test.path)
+		if endpoint == nil {
+			t.Errorf("%s: expected a match", test.path)
+			continue
+		}
+		out, err := api.Call("GET", test.path, nil, nil)
+		if err != nil || out != test.expected {
+			t.Errorf("%s: expected %s, got %v (%v)", test.path, test.expected, out, err)
+		}
+		if fmt.Sprint(vars) != fmt.Sprint(test.vars) {
+			t.Errorf("%s: expected vars %v, got %v", test.path, test.vars, vars)
+		}
+	}
+
+	for _, path := range []string{"/users", "/users/me/posts", "/users/1/likes/x", "/"} {
+		if endpoint, _ := api.MatchEndpoint("GET", path); endpoint != nil {
+			t.Errorf("%s: unexpected match %s", path, endpoint.Path)
+		}
+	}
+	if endpoint, _ := api.MatchEndpoint("POST", "/users/me"); endpoint != nil {
+		t.Errorf("unexpected match %s", endpoint.Path)
+	}
+}
+
+func TestRouterRoot(t *testing.T) {
+	api := dispatch.API{}
+	api.AddEndpoint("GET/", func() string { return "root" })
+
+	for _, path := range []string{"/", ""} {
+		if endpoint, _ := api.MatchEndpoint("GET", path); endpoint == nil {
+			t.Errorf("%q: expected a match", path)
+		}
+	}
+	if endpoint, _ := api.MatchEndpoint("GET", "/x"); endpoint != nil {
+		t.Errorf("unexpected match %s", endpoint.Path)
+	}
+}
+
+func BenchmarkMatchEndpoint(b *testing.B) {
+	api := dispatch.API{}
+	for i := 0; i < 300; i++ {
+		api.AddEndpoint(fmt.Sprintf("GET/resource%d/{id}/items/{item}", i), func() {})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		api.MatchEndpoint("GET", "/resource299/abc/items/def")
+	}
+}
+
+func TestRouteConflicts(t *testing.T) {
+	api := dispatch.API{}
+	api.AddEndpoint("GET/users/{id}", func() string { return "id" })
+	api.AddEndpoint("GET/users/me", func() string { return "me" })
+	api.AddEndpoint("POST/users/{id}", func() string { return "post" })
+	if err := api.Validate(); err != nil {
+		t.Errorf("expected no conflicts, got %v", err)
+	}
+
+	api.AddEndpoint("GET/users/me", func() string { return "me again" })
+	api.AddEndpoint("GET/users/{uid}", func() string { return "uid" })
+	err := api.Validate()
+	conflicts, ok := err.(dispatch.RouteConflicts)
+	if !ok || len(conflicts) != 2 {
+		t.Fatalf("expected two conflicts, got %v", err)
+	}
+	if conflicts[0].Path != "GET/users/me" || conflicts[0].Existing != "GET/users/me" {
+		t.Errorf("unexpected conflict %v", conflicts[0])
+	}
+	if conflicts[1].Path != "GET/users/{uid}" || conflicts[1].Existing != "GET/users/{id}" {
+		t.Errorf("unexpected conflict %v", conflicts[1])
+	}
+
+	// The endpoint registered first is still matched
+	out, err := api.Call("GET", "/users/me", nil, nil)
+	if out != "me" || err != nil {
+		t.Errorf("expected me, got %v (%v)", out, err)
+	}
+	_, vars := api.MatchEndpoint("GET", "/users/1")
+	if vars["id"] != "1" {
+		t.Errorf("expected id var, got %v", vars)
+	}
+}
+
+func TestRouterCatchAll(t *testing.T) {
+	api := dispatch.API{}
+	api.AddEndpoint("GET/files/{path...}", func() string { return "files" })
+	api.AddEndpoint("GET/files/{name}", func() string { return "name" })
+	api.AddEndpoint("GET/files/index.html", func() string { return "index" })
+
+	tests := []struct {
+		path     string
+		expected string
+		vars     dispatch.PathVars
+	}{
+		{"/files/index.html", "index", dispatch.PathVars{}},
+		{"/files/a.txt", "name", dispatch.PathVars{"name": "a.txt"}},
+		{"/files/css/site.css", "files", dispatch.PathVars{"path": "css/site.css"}},
+		{"/files/", "name", dispatch.PathVars{"name": ""}},
+		{"/files/a/b/", "files", dispatch.PathVars{"path": "a/b/"}},
+	}
+	for _, test := range tests {
+		_, vars := api.MatchEndpoint("GET", test.path)
+		out, err := api.Call("GET", test.path, nil, nil)
+		if err != nil || out != test.expected {
+			t.Errorf("%s: expected %s, got %v (%v)", test.path, test.expected, out, err)
+		}
+		if fmt.Sprint(vars) != fmt.Sprint(test.vars) {
+			t.Errorf("%s: expected vars %v, got %v", test.path, test.vars, vars)
+		}
+	}
+	if endpoint, _ := api.MatchEndpoint("GET", "/files"); endpoint != nil {
+		t.Errorf("unexpected match %s", endpoint.Path)
+	}
+}
+
+func TestRouterTrailingSlash(t *testing.T) {
+	api := dispatch.API{}
+	api.AddEndpoint("GET/users", func() string { return "users" })
+	api.AddEndpoint("GET/posts/", func() string { return "posts" })
+
+	if endpoint, _ := api.MatchEndpoint("GET", "/users/"); endpoint != nil {
+		t.Errorf("unexpected match %s", endpoint.Path)
+	}
+
+	api.IgnoreTrailingSlash = true
+	for _, path := range []string{"/users", "/users/", "/posts", "/posts/"} {
+		if endpoint, _ := api.MatchEndpoint("GET", path); endpoint == nil {
+			t.Errorf("%s: expected a match", path)
+		}
+	}
+	if endpoint, _ := api.MatchEndpoint("GET", "/users//"); endpoint != nil {
+		t.Errorf("unexpected match %s", endpoint.Path)
+	}
+}
+
+func TestRouterConstraints(t *testing.T) {
+	api := dispatch.API{}
+	api.AddEndpoint("GET/items/{slug}", func() string { return "slug" })
+	api.AddEndpoint("GET/items/{id:int}", func() string { return "int" })
+	api.AddEndpoint("GET/items/{id:uuid}", func() string { return "uuid" })
+	api.AddEndpoint("GET/only/{id:int}", func() string { return "only" })
+	// Named constraints are tried before regular expressions
+	api.AddEndpoint("GET/u/{slug:[a-z0-9]+}", func() string { return "regex" })
+	api.AddEndpoint("GET/u/{id:int}", func() string { return "int" })
+
+	tests := map[string]string{
+		"/items/42": "int",
+		"/items/6ba7b810-9dad-11d1-80b4-00c04fd430c8": "uuid",
+		"/items/hello": "slug",
+		"/only/7":      "only",
+		"/u/123":       "int",
+		"/u/abc123":    "regex",
+	}
+	for path, expected := range tests {
+		out, err := api.Call("GET", path, nil, nil)
+		if err != nil || out != expected {
+			t.Errorf("%s: expected %s, got %v (%v)", path, expected, out, err)
+		}
+	}
+	if endpoint, _ := api.MatchEndpoint("GET", "/only/seven"); endpoint != nil {
+		t.Errorf("unexpected match %s", endpoint.Path)
+	}
+	if err := api.Validate(); err != nil {
+		t.Errorf("expected no conflicts, got %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package dispatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"strings"
+)
+
+// Media types that streamed outputs can be sent as, in order of preference.
+const (
+	ndjsonType      = "application/x-ndjson"
+	eventStreamType = "text/event-stream"
+)
+
+var streamTypes = []string{ndjsonType, eventStreamType}
+
+// An Event is an item of a streamed output with the fields of a Server-Sent
+// Event. When the output is sent as newline-delimited JSON, only Data is sent.
+type Event struct {
+	// ID is the event ID, which browsers send back in the Last-Event-ID header
+	// when they reconnect.
+	ID string
+	// Name is the event type, such as "progress". If empty, the browser
+	// dispatches a "message" event.
+	Name string
+	// Data is encoded as JSON.
+	Data interface{}
+}
+
+// isStreamType reports whether t is a type of output that is streamed: a
+// channel that can be received from, or an iterator function of the form
+// func(yield func(T) bool) or func(yield func(T, error) bool).
+func isStreamType(t reflect.Type) bool {
+	if t == nil {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Chan:
+		return t.ChanDir()&reflect.RecvDir != 0
+	case reflect.Func:
+		if t.NumIn() != 1 || t.NumOut() != 0 {
+			return false
+		}
+		yield := t.In(0)
+		return yield.Kind() == reflect.Func && yield.NumOut() == 1 && yield.Out(0).Kind() == reflect.Bool &&
+			(yield.NumIn() == 1 || yield.NumIn() == 2 && yield.In(1) == errorType)
+	}
+	return false
+}
+
+// writeStream sends each item of a streamed output as it is received, as
+// newline-delimited JSON or Server-Sent Events depending on mediaType. The
+// response is flushed after each item. The stream ends when the channel is
+// closed or the iterator returns, when an error is received, or when the
+// client disconnects.
+func (api *API) writeStream(w http.ResponseWriter, r *http.Request, output interface{}, mediaType, requestID string) {
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	rc := http.NewResponseController(w)
+	rc.Flush()
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Printf("Stream panic in request %s: %v\n", requestID, rec)
+			debug.PrintStack()
+		}
+	}()
+
+	ctx := r.Context()
+	send := func(item interface{}, err error) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		var buf bytes.Buffer
+		if err == nil {
+			err = encodeStreamItem(&buf, item, mediaType)
+		}
+		if err != nil {
+			_, body := api.encodeError(err, requestID)
+			buf.Reset()
+			if mediaType == eventStreamType {
+				fmt.Fprintf(&buf, "event: error\ndata: %s\n\n", body)
+			} else {
+				fmt.Fprintf(&buf, "%s\n", body)
+			}
+		}
+		if _, writeErr := w.Write(buf.Bytes()); writeErr != nil {
+			return false
+		}
+		rc.Flush()
+		return err == nil
+	}
+
+	v := reflect.ValueOf(output)
+	if v.IsNil() {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Chan:
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: v},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+		}
+		for {
+			chosen, item, ok := reflect.Select(cases)
+			if chosen == 1 || !ok || !send(item.Interface(), nil) {
+				return
+			}
+		}
+	case reflect.Func:
+		yield := reflect.MakeFunc(v.Type().In(0), func(args []reflect.Value) []reflect.Value {
+			var err error
+			if len(args) == 2 && !args[1].IsNil() {
+				err = args[1].Interface().(error)
+			}
+			return []reflect.Value{reflect.ValueOf(send(args[0].Interface(), err))}
+		})
+		v.Call([]reflect.Value{yield})
+	}
+}
+
+// encodeStreamItem writes an item of a stream to buf in the format of
+// mediaType.
+func encodeStreamItem(buf *bytes.Buffer, item interface{}, mediaType string) error {
+	var event Event
+	switch item := item.(type) {
+	case Event:
+		event = item
+	case *Event:
+		if item != nil {
+			event = *item
+		}
+	default:
+		event.Data = item
+	}
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+	if mediaType != eventStreamType {
+		buf.Write(data)
+		buf.WriteByte('\n')
+		return nil
+	}
+	// Field values can't contain line breaks
+	clean := strings.NewReplacer("\r", "", "\n", "")
+	if event.ID != "" {
+		fmt.Fprintf(buf, "id: %s\n", clean.Replace(event.ID))
+	}
+	if event.Name != "" {
+		fmt.Fprintf(buf, "event: %s\n", clean.Replace(event.Name))
+	}
+	fmt.Fprintf(buf, "data: %s\n\n", data)
+	return nil
+}
@@ -0,0 +1,137 @@
+package dispatch_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/olafal0/dispatch"
+)
+
+func TestStream(t *testing.T) {
+	api := &dispatch.API{}
+	api.AddEndpoint("GET/count", func(ctx *dispatch.Context) <-chan int {
+		ch := make(chan int)
+		go func() {
+			defer close(ch)
+			for i := 1; i <= 3; i++ {
+				select {
+				case ch <- i:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return ch
+	})
+	events := dispatch.Handle(api, "GET/events", func(ctx *dispatch.Context, _ struct{}) (func(yield func(dispatch.Event, error) bool), error) {
+		return func(yield func(dispatch.Event, error) bool) {
+			if !yield(dispatch.Event{ID: "1", Name: "progress", Data: map[string]int{"done": 50}}, nil) {
+				return
+			}
+			yield(dispatch.Event{}, dispatch.ErrorConflict)
+		}, nil
+	})
+	events.DecodeOptions = &dispatch.DecodeOptions{AllowEmptyBody: true}
+
+	rec := doRequest(api.ServeHTTP, "GET", "/count", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "1\n2\n3\n" {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Unexpected Content-Type %q", ct)
+	}
+	if !rec.Flushed {
+		t.Error("Stream was not flushed")
+	}
+
+	req := httptest.NewRequest("GET", "/count", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	rec = httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	if rec.Body.String() != "data: 1\n\ndata: 2\n\ndata: 3\n\n" {
+		t.Errorf("Unexpected response %q", rec.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/events", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	rec = httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	expected := "id: 1\nevent: progress\ndata: {\"done\":50}\n\nevent: error\ndata: {\"error\":{\"code\":\"conflict\",\"message\":\"Conflict\",\"request_id\":\"" + rec.Header().Get("X-Request-Id") + "\"}}\n\n"
+	if rec.Body.String() != expected {
+		t.Errorf("Unexpected response %q", rec.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/events", nil)
+	req.Header.Set("Accept", "application/xml")
+	rec = httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotAcceptable {
+		t.Errorf("Expected 406, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStreamDisconnect(t *testing.T) {
+	api := &dispatch.API{}
+	stopped := make(chan error, 1)
+	api.AddEndpoint("GET/forever", func(ctx *dispatch.Context) chan string {
+		ch := make(chan string)
+		go func() {
+			for {
+				select {
+				case ch <- "tick":
+				case <-ctx.Done():
+					stopped <- ctx.Err()
+					return
+				}
+			}
+		}()
+		return ch
+	})
+
+	reqCtx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/forever", nil).WithContext(reqCtx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	done := make(chan struct{})
+	go func() {
+		api.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Stream did not stop when the client disconnected")
+	}
+	if err := <-stopped; !errors.Is(err, context.Canceled) {
+		t.Errorf("Unexpected context error %v", err)
+	}
+}
+
+func TestStreamTimeout(t *testing.T) {
+	api := &dispatch.API{}
+	slow := api.AddEndpoint("GET/slow", func(ctx *dispatch.Context) <-chan int {
+		ch := make(chan int)
+		go func() {
+			defer close(ch)
+			for i := 1; i <= 2; i++ {
+				time.Sleep(20 * time.Millisecond)
+				select {
+				case ch <- i:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return ch
+	})
+	slow.Timeout = 10 * time.Millisecond
+
+	// The timeout doesn't cancel a stream
+	rec := doRequest(api.ServeHTTP, "GET", "/slow", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "1\n2\n" {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+}
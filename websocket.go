@@ -0,0 +1,289 @@
+package dispatch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// errUpgradeRequired is returned for requests to a WebSocket endpoint that
+// are not WebSocket handshakes.
+var errUpgradeRequired = NewHTTPError(http.StatusUpgradeRequired, "upgrade_required", "WebSocket upgrade required")
+
+// isWebSocketHandler reports whether a handler type takes a directional
+// channel, which makes it a WebSocket handler.
+func isWebSocketHandler(handlerType reflect.Type) bool {
+	for i := 0; i < handlerType.NumIn(); i++ {
+		if in := handlerType.In(i); in.Kind() == reflect.Chan && in.ChanDir() != reflect.BothDir {
+			return true
+		}
+	}
+	return false
+}
+
+// newWebSocketInfo checks the signature of a WebSocket handler, and returns an
+// invoker for it. WebSocket handlers can take a Context, a receive-only channel
+// of incoming messages, and a send-only channel of outgoing messages, in any
+// order, and can return an error.
+func newWebSocketInfo(handler interface{}) (*handlerInfo, error) {
+	handlerType := reflect.TypeOf(handler)
+	ctxIndex, inIndex, outIndex := -1, -1, -1
+	var ctxPointer bool
+	for i := 0; i < handlerType.NumIn(); i++ {
+		arg := handlerType.In(i)
+		switch {
+		case (arg == contextType || arg == contextPtrType) && ctxIndex < 0:
+			ctxIndex = i
+			ctxPointer = arg == contextPtrType
+		case arg.Kind() == reflect.Chan && arg.ChanDir() == reflect.RecvDir && inIndex < 0:
+			inIndex = i
+		case arg.Kind() == reflect.Chan && arg.ChanDir() == reflect.SendDir && outIndex < 0:
+			outIndex = i
+		default:
+			return nil, fmt.Errorf("WebSocket handler %s has unexpected argument %s", handlerType, arg)
+		}
+	}
+	if handlerType.NumOut() > 1 || handlerType.NumOut() == 1 && handlerType.Out(0) != errorType {
+		return nil, fmt.Errorf("WebSocket handler %s must return nothing or an error", handlerType)
+	}
+
+	ws := &webSocketHandler{
+		handler:    reflect.ValueOf(handler),
+		ctxIndex:   ctxIndex,
+		ctxPointer: ctxPointer,
+		inIndex:    inIndex,
+		outIndex:   outIndex,
+	}
+	if inIndex >= 0 {
+		ws.inType = handlerType.In(inIndex).Elem()
+		ws.required = hasRequiredFields(ws.inType)
+	}
+	if outIndex >= 0 {
+		ws.outType = handlerType.In(outIndex).Elem()
+	}
+	return &handlerInfo{
+		streamBody:     true,
+		writesResponse: true,
+		webSocket:      true,
+		invoke:         ws.invoke,
+	}, nil
+}
+
+// webSocketHandler calls a WebSocket handler for each connection.
+type webSocketHandler struct {
+	handler    reflect.Value
+	ctxIndex   int
+	ctxPointer bool
+	inIndex    int
+	inType     reflect.Type
+	required   bool
+	outIndex   int
+	outType    reflect.Type
+}
+
+// invoke upgrades the request to a WebSocket connection, and calls the handler
+// with channels for the connection's messages. It returns when the handler
+// does, and closes the connection. Since the response is written by the
+// upgrade, the Context records that it was written.
+func (ws *webSocketHandler) invoke(ctx *Context, input json.RawMessage) (interface{}, error) {
+	if ctx.Request == nil || ctx.Writer == nil {
+		return nil, errors.New("WebSocket endpoints require an HTTP request")
+	}
+	if !websocket.IsWebSocketUpgrade(ctx.Request) {
+		return nil, errUpgradeRequired
+	}
+	upgrader := websocket.Upgrader{CheckOrigin: ctx.checkOrigin()}
+	// If the upgrade fails, the upgrader writes an error response
+	ctx.setResponseWritten()
+	conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// Messages are limited like request bodies
+	limit := int64(DefaultMaxBodySize)
+	if ctx.api != nil {
+		limit = ctx.api.maxBodySize(ctx.endpoint)
+	}
+	if limit > 0 {
+		conn.SetReadLimit(limit)
+	}
+
+	// The context is canceled when the connection is closed, or the handler
+	// returns
+	connCtx, cancel := context.WithCancel(ctx.context())
+	defer cancel()
+	ctx.ctx = connCtx
+	ctx.Request = ctx.Request.WithContext(connCtx)
+
+	var writeMu sync.Mutex
+	writeMessage := func(data []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteMessage(websocket.TextMessage, data)
+	}
+	writeError := func(err error) {
+		httpErr := toHTTPError(err, ctx.api != nil && ctx.api.HideInternalErrors)
+		body, _ := json.Marshal(errorBody{errorBodyContent{httpErr.Code, httpErr.Message, httpErr.Details, ctx.RequestID}})
+		writeMessage(body)
+	}
+
+	args := make([]reflect.Value, ws.handler.Type().NumIn())
+	if ws.ctxIndex >= 0 {
+		if ws.ctxPointer {
+			args[ws.ctxIndex] = reflect.ValueOf(ctx)
+		} else {
+			args[ws.ctxIndex] = reflect.ValueOf(*ctx)
+		}
+	}
+
+	// Incoming messages are read until the connection is closed, even if the
+	// handler doesn't receive them, so that control messages are processed
+	var in reflect.Value
+	if ws.inIndex >= 0 {
+		in = reflect.MakeChan(reflect.ChanOf(reflect.BothDir, ws.inType), 0)
+		args[ws.inIndex] = in
+	}
+	go func() {
+		defer cancel()
+		if in.IsValid() {
+			defer in.Close()
+		}
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if !in.IsValid() {
+				continue
+			}
+			msg := reflect.New(ws.inType)
+			if err := ws.decode(ctx, data, msg.Interface()); err != nil {
+				writeError(err)
+				continue
+			}
+			chosen, _, _ := reflect.Select([]reflect.SelectCase{
+				{Dir: reflect.SelectSend, Chan: in, Send: msg.Elem()},
+				{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(connCtx.Done())},
+			})
+			if chosen == 1 {
+				return
+			}
+		}
+	}()
+
+	// Outgoing messages are received until the handler returns. If the
+	// connection fails, they are discarded.
+	handlerDone := make(chan struct{})
+	writerDone := make(chan struct{})
+	if ws.outIndex >= 0 {
+		out := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, ws.outType), 0)
+		args[ws.outIndex] = out
+		go func() {
+			defer close(writerDone)
+			failed := false
+			for {
+				chosen, msg, _ := reflect.Select([]reflect.SelectCase{
+					{Dir: reflect.SelectRecv, Chan: out},
+					{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(handlerDone)},
+				})
+				if chosen == 1 {
+					return
+				}
+				if failed {
+					continue
+				}
+				data, err := json.Marshal(msg.Interface())
+				if err != nil {
+					log.Printf("Error encoding WebSocket message in request %s: %v", ctx.RequestID, err)
+					continue
+				}
+				if err := writeMessage(data); err != nil {
+					failed = true
+					cancel()
+				}
+			}
+		}()
+	} else {
+		close(writerDone)
+	}
+
+	var handlerErr error
+	func() {
+		defer close(handlerDone)
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("WebSocket handler panic in request %s: %v", ctx.RequestID, r)
+				handlerErr = ErrorInternal
+			}
+		}()
+		if results := ws.handler.Call(args); len(results) == 1 && !results[0].IsNil() {
+			handlerErr = results[0].Interface().(error)
+		}
+	}()
+	<-writerDone
+
+	code, text := websocket.CloseNormalClosure, ""
+	if handlerErr != nil {
+		httpErr := toHTTPError(handlerErr, ctx.api != nil && ctx.api.HideInternalErrors)
+		// Client errors use the application range of close codes
+		code, text = websocket.CloseInternalServerErr, httpErr.Message
+		if httpErr.Status >= 400 && httpErr.Status < 500 {
+			code = 4000 + httpErr.Status
+		}
+		// Control messages are limited to 125 bytes
+		if len(text) > 123 {
+			text = text[:123]
+		}
+	}
+	writeMu.Lock()
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+	writeMu.Unlock()
+	return nil, handlerErr
+}
+
+// decode decodes an incoming message the same way as an endpoint's input.
+func (ws *webSocketHandler) decode(ctx *Context, data []byte, dst interface{}) error {
+	opts := ctx.decodeOptions
+	if opts == nil {
+		opts = &DecodeOptions{}
+	}
+	if err := decodeJSON(data, dst, opts); err != nil {
+		return err
+	}
+	if ws.required {
+		return checkRequired(reflect.ValueOf(dst).Elem(), "")
+	}
+	return nil
+}
+
+// checkOrigin returns the function used to accept the origin of a WebSocket
+// handshake. If the API has a CORS policy, origins that it allows explicitly
+// are accepted, along with the request's own origin. Since handshakes always
+// include cookies, origins that are only allowed by "*" are not. If there is
+// no policy, nil is returned, so that only the request's own origin is
+// accepted.
+func (c *Context) checkOrigin() func(r *http.Request) bool {
+	if c.api == nil || c.api.CORS == nil {
+		return nil
+	}
+	cors := c.api.CORS
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if allowed := cors.allowOrigin(origin); origin == "" || allowed != "" && allowed != "*" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+}
@@ -0,0 +1,124 @@
+package dispatch_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/olafal0/dispatch"
+)
+
+type chatMessage struct {
+	Room string `json:"room"`
+	Text string `json:"text" required:"true"`
+}
+
+func TestWebSocket(t *testing.T) {
+	api := &dispatch.API{}
+	api.AddEndpoint("GET/ws/{room}", func(ctx *dispatch.Context, in <-chan chatMessage, out chan<- chatMessage) error {
+		for msg := range in {
+			if msg.Text == "bye" {
+				return dispatch.ErrorConflict
+			}
+			out <- chatMessage{Room: ctx.PathVars["room"], Text: msg.Text}
+		}
+		return nil
+	}, func(in *dispatch.EndpointInput) (*dispatch.EndpointInput, error) {
+		if in.Ctx.Request.Header.Get("Authorization") == "" {
+			return nil, dispatch.ErrorUnauthorized
+		}
+		return in, nil
+	})
+	server := httptest.NewServer(api)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/lobby"
+
+	// Hooks run before the connection is upgraded
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected unauthorized, got %v", err)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/ws/lobby", nil)
+	req.Header.Set("Authorization", "yes")
+	api.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUpgradeRequired {
+		t.Errorf("Expected 426, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Authorization": {"yes"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var msg chatMessage
+	conn.WriteJSON(chatMessage{Text: "hello"})
+	if err := conn.ReadJSON(&msg); err != nil || msg.Room != "lobby" || msg.Text != "hello" {
+		t.Errorf("Unexpected message %+v, %v", msg, err)
+	}
+
+	// Invalid messages are answered with an error, without ending the handler
+	var errMsg testErrorBody
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"room":"x"}`))
+	if err := conn.ReadJSON(&errMsg); err != nil || errMsg.Error.Code != "bad_request" {
+		t.Errorf("Unexpected error message %+v, %v", errMsg, err)
+	}
+	conn.WriteJSON(chatMessage{Text: "again"})
+	if err := conn.ReadJSON(&msg); err != nil || msg.Text != "again" {
+		t.Errorf("Unexpected message %+v, %v", msg, err)
+	}
+
+	// Handler errors close the connection
+	conn.WriteJSON(chatMessage{Text: "bye"})
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != 4409 || closeErr.Text != "Conflict" {
+		t.Errorf("Unexpected close error %v", err)
+	}
+}
+
+func TestWebSocketLimits(t *testing.T) {
+	api := &dispatch.API{CORS: &dispatch.CORSConfig{AllowedOrigins: []string{"https://app.example.com", "*"}}}
+	echo := api.AddEndpoint("GET/echo", func(in <-chan string, out chan<- string) {
+		for msg := range in {
+			out <- msg
+		}
+	})
+	echo.Timeout = 10 * time.Millisecond
+	echo.MaxBodySize = 16
+	server := httptest.NewServer(api)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/echo"
+
+	// Cross-origin handshakes are only accepted from listed origins
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://evil.example.com"}})
+	if err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected cross-origin handshake to be rejected, got %v", err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://app.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The endpoint's Timeout doesn't end the connection
+	time.Sleep(20 * time.Millisecond)
+	var msg string
+	conn.WriteJSON("hello")
+	if err := conn.ReadJSON(&msg); err != nil || msg != "hello" {
+		t.Errorf("Unexpected message %q, %v", msg, err)
+	}
+
+	// Messages larger than MaxBodySize close the connection
+	conn.WriteJSON(strings.Repeat("a", 32))
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseMessageTooBig {
+		t.Errorf("Unexpected close error %v", err)
+	}
+}